@@ -0,0 +1,14 @@
+package main
+
+import (
+	"syscall"
+)
+
+// Report whether the file at the given path has file capabilities, i.e. a
+// security.capability extended attribute.
+func hasCapability(path string) bool {
+	_, err := syscall.Getxattr(path, "security.capability", nil)
+	return err == nil
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
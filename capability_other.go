@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// File capabilities only exist on Linux.
+func hasCapability(path string) bool {
+	return false
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The dircolors database keywords, and the LS_COLORS keys they stand for.
+var dircolorsKeywords = map[string]string{
+	"NORMAL":                "no",
+	"NORM":                  "no",
+	"FILE":                  "fi",
+	"RESET":                 "rs",
+	"DIR":                   "di",
+	"LNK":                   "ln",
+	"LINK":                  "ln",
+	"SYMLINK":               "ln",
+	"MULTIHARDLINK":         "mh",
+	"FIFO":                  "pi",
+	"PIPE":                  "pi",
+	"SOCK":                  "so",
+	"DOOR":                  "do",
+	"BLK":                   "bd",
+	"BLOCK":                 "bd",
+	"CHR":                   "cd",
+	"CHAR":                  "cd",
+	"ORPHAN":                "or",
+	"MISSING":               "mi",
+	"SETUID":                "su",
+	"SUID":                  "su",
+	"SETGID":                "sg",
+	"SGID":                  "sg",
+	"CAPABILITY":            "ca",
+	"STICKY_OTHER_WRITABLE": "tw",
+	"OWT":                   "tw",
+	"OTHER_WRITABLE":        "ow",
+	"OWR":                   "ow",
+	"STICKY":                "st",
+	"EXEC":                  "ex",
+	"LEFT":                  "lc",
+	"LEFTCODE":              "lc",
+	"RIGHT":                 "rc",
+	"RIGHTCODE":             "rc",
+	"END":                   "ec",
+	"ENDCODE":               "ec",
+	"CLRTOEOL":              "cl",
+}
+
+// The LS_COLORS type keys in the order they are printed by --print-colors.
+var lsColorsOrder = []string{
+	"no", "fi", "di", "ln", "mh", "pi", "so", "do", "bd", "cd", "or", "mi",
+	"su", "sg", "ca", "tw", "ow", "st", "ex",
+}
+
+// Read a dircolors database file (the format of `dircolors --print-database`)
+// and convert it to an LS_COLORS string.  As with dircolors, entries below TERM
+// and COLORTERM lines only apply if one of the patterns matches the current
+// terminal.  Unknown keywords are skipped.
+func parseDircolorsFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	term := os.Getenv("TERM")
+	colorTerm := os.Getenv("COLORTERM")
+
+	const (
+		stateGlobal   = iota // no TERM lines seen yet
+		stateTermNo          // the last TERM block did not match
+		stateTermSure        // inside a TERM block that matched
+		stateTermYes         // after a TERM block that matched
+	)
+	state := stateGlobal
+
+	entries := make([]string, 0)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// strip comments, which start at a '#' at the beginning of the line
+		// or after whitespace
+		for i := 0; i < len(line); i++ {
+			if line[i] == '#' && (i == 0 || line[i-1] == ' ' ||
+				line[i-1] == '\t') {
+				line = line[:i]
+				break
+			}
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		keyword := fields[0]
+		arg := fields[1]
+
+		if strings.EqualFold(keyword, "TERM") ||
+			strings.EqualFold(keyword, "COLORTERM") {
+			value := term
+			if strings.EqualFold(keyword, "COLORTERM") {
+				value = colorTerm
+			}
+
+			matched, _ := filepath.Match(arg, value)
+			if matched {
+				state = stateTermSure
+			} else if state != stateTermSure {
+				state = stateTermNo
+			}
+			continue
+		}
+
+		if state == stateTermSure {
+			state = stateTermYes
+		}
+		if state == stateTermNo {
+			continue
+		}
+
+		if keyword[0] == '.' {
+			entries = append(entries, fmt.Sprintf("*%s=%s", keyword, arg))
+		} else if keyword[0] == '*' {
+			entries = append(entries, fmt.Sprintf("%s=%s", keyword, arg))
+		} else if key, ok := dircolorsKeywords[strings.ToUpper(keyword)]; ok {
+			entries = append(entries, fmt.Sprintf("%s=%s", key, arg))
+		}
+		// OPTIONS, COLOR, EIGHTBIT and unknown keywords are ignored
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return strings.Join(entries, ":"), nil
+}
+
+// Escape a key or value of LS_COLORS, so it can't be mistaken for the
+// separators and survives the single quotes of --print-colors.
+func escapeLsColors(s string) string {
+	var escaped bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == 27 {
+			escaped.WriteString("\\e")
+		} else if s[i] < ' ' || s[i] == 127 || s[i] == ':' || s[i] == '=' ||
+			s[i] == '\\' || s[i] == '^' || s[i] == '\'' {
+			escaped.WriteString(fmt.Sprintf("\\%03o", s[i]))
+		} else {
+			escaped.WriteByte(s[i])
+		}
+	}
+
+	return escaped.String()
+}
+
+// Return the code between lc and rc of an escape sequence from the colorMap,
+// e.g. "\x1b[01;34m" -> "01;34", and whether it is wrapped in them at all.
+func stripLsColorsCode(code string) (string, bool) {
+	if len(code) < len(colorLeft)+len(colorRight) ||
+		!strings.HasPrefix(code, colorLeft) ||
+		!strings.HasSuffix(code, colorRight) {
+		return code, false
+	}
+
+	inner := code[len(colorLeft) : len(code)-len(colorRight)]
+	if strings.Contains(inner, "\x1b") ||
+		(colorRight != "" && strings.Contains(inner, colorRight)) {
+		// more than one sequence
+		return code, false
+	}
+
+	return inner, true
+}
+
+// Turn an escape sequence from the colorMap back into an LS_COLORS value, e.g.
+// "\x1b[01;34m" -> "01;34".  Anything that isn't a single sequence between lc
+// and rc is written out whole, with backslash escapes.
+func lsColorsValue(code string) string {
+	inner, _ := stripLsColorsCode(code)
+	return escapeLsColors(inner)
+}
+
+// Return the effective color configuration as an LS_COLORS string, so it can
+// be exported as-is.
+func getEffectiveLsColors() string {
+	entries := make([]string, 0)
+
+	if colorLeft != lsColorsDefaults["lc"] ||
+		colorRight != lsColorsDefaults["rc"] {
+		entries = append(entries, "lc="+escapeLsColors(colorLeft),
+			"rc="+escapeLsColors(colorRight))
+	}
+
+	reset, ok := stripLsColorsCode(colorMap["end"])
+	if ok && reset != "" {
+		entries = append(entries, "rs="+escapeLsColors(reset))
+	} else if colorMap["end"] != "" {
+		// a custom end code can't be expressed as a reset code
+		entries = append(entries, "ec="+escapeLsColors(colorMap["end"]))
+	}
+
+	for _, key := range lsColorsOrder {
+		if key == "ln" && linkAsTarget {
+			entries = append(entries, "ln=target")
+		} else if colorMap[lsColorsKeys[key]] != "" {
+			entries = append(entries, fmt.Sprintf("%s=%s", key,
+				lsColorsValue(colorMap[lsColorsKeys[key]])))
+		}
+	}
+
+	for _, p := range colorPatterns {
+		entries = append(entries, fmt.Sprintf("%s=%s",
+			escapeLsColors(p.pattern), lsColorsValue(p.color)))
+	}
+
+	return strings.Join(entries, ":")
+}
+
+// Write the effective color configuration to the output: first as an LS_COLORS
+// string, then as a table of file types and name patterns with a sample of each
+// color (unless --nocolor).
+func printColors(output *outputWriter) {
+	output.WriteString(fmt.Sprintf("LS_COLORS='%s'\n", getEffectiveLsColors()))
+
+	// write a sample in the given color, padded to the given width
+	writeSample := func(sample string, color string, width int) {
+		if options.color && color != "" {
+			output.WriteString(color)
+			output.WriteString(sample)
+			output.WriteString(colorMap["end"])
+		} else {
+			output.WriteString(sample)
+		}
+		for i := 0; i < width-displayWidth(sample); i++ {
+			output.WriteString(" ")
+		}
+	}
+
+	widthName := len("TYPE")
+	for _, key := range lsColorsOrder {
+		if len(lsColorsKeys[key]) > widthName {
+			widthName = len(lsColorsKeys[key])
+		}
+	}
+
+	output.WriteString("\nKEY  ")
+	writeSample("TYPE", "", widthName)
+	output.WriteString("  CODE")
+	for _, key := range lsColorsOrder {
+		name := lsColorsKeys[key]
+		output.WriteString(fmt.Sprintf("\n%s   ", key))
+		writeSample(name, colorMap[name], widthName)
+		output.WriteString("  ")
+		if colorMap[name] == "" {
+			output.WriteString("-")
+		} else {
+			output.WriteString(lsColorsValue(colorMap[name]))
+		}
+	}
+
+	if len(colorPatterns) == 0 {
+		return
+	}
+
+	// list the patterns alphabetically, but keep only the one that wins (the
+	// last one) for each pattern
+	effective := make(map[string]string)
+	for _, p := range colorPatterns {
+		effective[p.pattern] = p.color
+	}
+	patterns := make([]string, 0, len(effective))
+	widthPattern := len("PATTERN")
+	for pattern := range effective {
+		patterns = append(patterns, pattern)
+		if displayWidth(pattern) > widthPattern {
+			widthPattern = displayWidth(pattern)
+		}
+	}
+	sort.Strings(patterns)
+
+	output.WriteString("\n\n")
+	writeSample("PATTERN", "", widthPattern)
+	output.WriteString("  CODE")
+	for _, pattern := range patterns {
+		output.WriteString("\n")
+		writeSample(pattern, effective[pattern], widthPattern)
+		output.WriteString("  ")
+		if effective[pattern] == "" {
+			output.WriteString("-")
+		} else {
+			output.WriteString(lsColorsValue(effective[pattern]))
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
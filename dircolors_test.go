@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Restore the color globals that a test changes once it is done.
+func saveColors(t *testing.T) {
+	savedMap, savedPatterns := colorMap, colorPatterns
+	savedLeft, savedRight := colorLeft, colorRight
+	savedLinkAsTarget := linkAsTarget
+	t.Cleanup(func() {
+		colorMap, colorPatterns = savedMap, savedPatterns
+		colorLeft, colorRight = savedLeft, savedRight
+		linkAsTarget = savedLinkAsTarget
+	})
+}
+
+func TestEffectiveLsColorsRoundTrip(t *testing.T) {
+	saveColors(t)
+
+	// a custom lc and rc, and patterns with the separators in them
+	colorMap = make(map[string]string)
+	parseLsColors("lc=\\e[1;:rc=\\a:di=34:*a\\072b=31:*x\\075y=32:*it\\047s=33")
+	wantColors := colorMap
+	wantPatterns := colorPatterns
+
+	lsColors := getEffectiveLsColors()
+	colorMap = make(map[string]string)
+	parseLsColors(lsColors)
+
+	if !reflect.DeepEqual(colorMap, wantColors) {
+		t.Errorf("%q gives colors %q, want %q", lsColors, colorMap,
+			wantColors)
+	}
+	if !reflect.DeepEqual(colorPatterns, wantPatterns) {
+		t.Errorf("%q gives patterns %q, want %q", lsColors, colorPatterns,
+			wantPatterns)
+	}
+}
+
+func TestPrintColorsBothVariables(t *testing.T) {
+	saveColors(t)
+	t.Setenv("LS_COLORS", "di=35:so=36:*.txt=31")
+	t.Setenv("LSCOLORS", "bxfxcxdxbxegedabagacad")
+
+	output := runLs(t, "--print-colors", "--nocolor", "--theme=/dev/null")
+	exported := strings.SplitN(output, "\n", 2)[0]
+
+	// di from LSCOLORS, and the pattern from LS_COLORS
+	for _, want := range []string{":di=0;31:", ":*.txt=31"} {
+		if !strings.Contains(exported, want) {
+			t.Errorf("%s doesn't have %s", exported, want)
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
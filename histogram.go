@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// The age buckets of --histogram=mtime, roughly growing by a constant factor,
+// from the newest to the oldest.
+var histogramAges = []struct {
+	name string
+	age  time.Duration
+}{
+	{"< 1 min", time.Minute},
+	{"< 10 min", 10 * time.Minute},
+	{"< 1 hour", time.Hour},
+	{"< 6 hours", 6 * time.Hour},
+	{"< 1 day", 24 * time.Hour},
+	{"< 1 week", 7 * 24 * time.Hour},
+	{"< 30 days", 30 * 24 * time.Hour},
+	{"< 90 days", 90 * 24 * time.Hour},
+	{"< 1 year", 365 * 24 * time.Hour},
+	{"< 3 years", 3 * 365 * 24 * time.Hour},
+	{">= 3 years", math.MaxInt64},
+}
+
+// One bar of a histogram.
+type histogramBucket struct {
+	label string
+	count int
+	color string // the color of the bar, "" for none
+}
+
+// A histogram of listings, with the function that picks the bucket of each.
+type histogram struct {
+	buckets  []histogramBucket
+	bucketOf func(l Listing) int
+}
+
+// Count a listing in its bucket.
+func (h *histogram) add(l Listing) {
+	h.buckets[h.bucketOf(l)].count++
+}
+
+// Return the size bucket of a number of bytes: 0 for empty files, k for sizes
+// from 4^(k-1) up to 4^k.
+func getSizeBucket(bytes int64) int {
+	return (bits.Len64(uint64(bytes)) + 1) / 2
+}
+
+// Return the label of a size bucket, e.g. "< 16K".
+func getSizeBucketLabel(bucket int) string {
+	if bucket == 0 {
+		return "0"
+	}
+
+	// 4^bucket is 2^(2*bucket), and every unit is 2^10 bytes more
+	unit := 2 * bucket / 10
+	if unit > 6 {
+		unit = 6
+	}
+	suffix := ""
+	if unit > 0 {
+		suffix = string("KMGTPE"[unit-1])
+	}
+
+	return fmt.Sprintf("< %d%s", uint64(1)<<uint(2*bucket-10*unit), suffix)
+}
+
+// Create the empty histogram of --histogram=size.
+func newSizeHistogram() *histogram {
+	buckets := make([]histogramBucket, getSizeBucket(math.MaxInt64)+1)
+	for i := range buckets {
+		buckets[i].label = getSizeBucketLabel(i)
+		smallest := int64(0)
+		if i > 0 {
+			smallest = 1 << uint(2*i-2)
+		}
+		buckets[i].color = getSizeColor(Listing{sizeBytes: smallest})
+	}
+
+	return &histogram{buckets, func(l Listing) int {
+		return getSizeBucket(l.sizeBytes)
+	}}
+}
+
+// Create the empty histogram of --histogram=mtime for ages relative to now,
+// with a bucket for times in the future first.
+func newAgeHistogram(now time.Time) *histogram {
+	buckets := []histogramBucket{{"future", 0,
+		getAgeColor(Listing{epochNano: now.UnixNano()})}}
+	youngest := time.Duration(0)
+	for _, a := range histogramAges {
+		buckets = append(buckets, histogramBucket{a.name, 0,
+			getAgeColor(Listing{epochNano: now.Add(-youngest).UnixNano()})})
+		youngest = a.age
+	}
+
+	return &histogram{buckets, func(l Listing) int {
+		age := now.Sub(time.Unix(0, l.epochNano))
+		if age < 0 {
+			return 0
+		}
+		for i, a := range histogramAges {
+			if age < a.age {
+				return i + 1
+			}
+		}
+		return len(histogramAges)
+	}}
+}
+
+// Write a histogram as horizontal bars scaled to the terminal width, from the
+// first to the last bucket that isn't empty.
+func writeHistogram(output *outputWriter, buckets []histogramBucket,
+	width int) {
+	first, last := -1, -1
+	maxCount := 0
+	for i, b := range buckets {
+		if b.count == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		if b.count > maxCount {
+			maxCount = b.count
+		}
+	}
+	if first < 0 {
+		return
+	}
+	buckets = buckets[first : last+1]
+
+	widthLabel := 0
+	widthCount := 0
+	for _, b := range buckets {
+		if displayWidth(b.label) > widthLabel {
+			widthLabel = displayWidth(b.label)
+		}
+		if len(formatNumber(int64(b.count))) > widthCount {
+			widthCount = len(formatNumber(int64(b.count)))
+		}
+	}
+	widthBar := width - widthLabel - widthCount - 4
+	if widthBar < 1 {
+		widthBar = 1
+	}
+
+	for i, b := range buckets {
+		if i > 0 {
+			output.WriteString("\n")
+		}
+		output.WriteString(fmt.Sprintf("%*s  %*s", widthLabel, b.label,
+			widthCount, formatNumber(int64(b.count))))
+		if b.count == 0 {
+			continue
+		}
+
+		// round up, so every bucket with entries gets a bar
+		length := (b.count*widthBar + maxCount - 1) / maxCount
+		bar := strings.Repeat("█", length)
+		output.WriteString("  ")
+		if options.color {
+			writeColored(output, bar, b.color)
+		} else {
+			output.WriteString(bar)
+		}
+	}
+}
+
+// Print the --histogram of the given files and of the contents of the given
+// directories (their whole trees with -R).  Directories themselves are left
+// out, as their sizes say little about what they hold.
+func writeHistograms(ctx context.Context, output *outputWriter,
+	files []Listing, dirs []Listing, width int) error {
+	h := newSizeHistogram()
+	if options.histogram == "mtime" {
+		h = newAgeHistogram(time.Now())
+	}
+	add := func(l Listing) {
+		if !l.timedOut && l.permissions[0] != 'd' {
+			h.add(l)
+		}
+	}
+
+	for _, l := range files {
+		add(l)
+	}
+	err := walkListings(ctx, output, dirs,
+		func(dir Listing, listings []Listing) {
+			for _, l := range listings {
+				add(l)
+			}
+		})
+	if err != nil {
+		return err
+	}
+
+	writeHistogram(output, h.buckets, width)
+
+	return nil
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSizeBuckets(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		label string
+	}{
+		{0, "0"},
+		{1, "< 4"},
+		{3, "< 4"},
+		{4, "< 16"},
+		{255, "< 256"},
+		{256, "< 1K"},
+		{1023, "< 1K"},
+		{1024, "< 4K"},
+		{1 << 20, "< 4M"},
+		{math.MaxInt64, "< 16E"},
+	}
+
+	h := newSizeHistogram()
+	for _, test := range tests {
+		bucket := getSizeBucket(test.bytes)
+		if label := getSizeBucketLabel(bucket); label != test.label {
+			t.Errorf("%d bytes went to %q, want %q", test.bytes, label,
+				test.label)
+		}
+		if h.bucketOf(Listing{sizeBytes: test.bytes}) != bucket {
+			t.Errorf("the histogram put %d bytes in another bucket",
+				test.bytes)
+		}
+	}
+}
+
+func TestAgeBuckets(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		age   time.Duration
+		label string
+	}{
+		{-time.Second, "future"},
+		{0, "< 1 min"},
+		{time.Minute - 1, "< 1 min"},
+		{time.Minute, "< 10 min"},
+		{time.Hour - 1, "< 1 hour"},
+		{time.Hour, "< 6 hours"},
+		{day, "< 1 week"},
+		{7 * day, "< 30 days"},
+		{365*day - 1, "< 1 year"},
+		{3*365*day - 1, "< 3 years"},
+		{3 * 365 * day, ">= 3 years"},
+		{100 * 365 * day, ">= 3 years"},
+	}
+
+	now := time.Now()
+	h := newAgeHistogram(now)
+	for _, test := range tests {
+		l := Listing{epochNano: now.Add(-test.age).UnixNano()}
+		if label := h.buckets[h.bucketOf(l)].label; label != test.label {
+			t.Errorf("an age of %v went to %q, want %q", test.age, label,
+				test.label)
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
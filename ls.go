@@ -3,14 +3,22 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh/terminal"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
+	"os/signal"
 	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -35,6 +43,14 @@ const (
 	colorBgWhite   = 47
 )
 
+// A file name pattern from LS_COLORS (e.g. "*.tar.gz" or "Makefile") with the
+// color code to use for matching files.
+type colorPattern struct {
+	pattern      string
+	patternLower string // the pattern in lower case, to ignore case
+	color        string
+}
+
 // This a FileInfo paired with the original path as passed in to the program.
 // Unfortunately, the Name() in FileInfo is only the basename, so the associated
 // path must be manually recorded as well.
@@ -57,37 +73,214 @@ type Options struct {
 	sortSize    bool
 	help        bool
 	dirsFirst   bool
+	jobs        int           // number of entries to stat in parallel
+	timeout     time.Duration // how long a single stat/readdir may take
+	printColors bool
+	dircolors   string // dircolors database file to take colors from
+	theme       string // theme file to take colors from
+
+	// long format columns to color (perms, size, age, owner)
+	colorColumns map[string]bool
+
+	quotingStyle string // how to quote file names (see quotingStyles)
+	hideControl  bool   // show non-printable characters as '?'
+
+	indicatorStyle string // none, slash, file-type or classify
+
+	columns bool // list names in columns, even if not writing to a terminal
+	across  bool // list names in rows instead of columns
+	commas  bool // list names separated by commas
+
+	inode     bool  // print the inode number of each file
+	blocks    bool  // print the allocated size of each file
+	blockSize int64 // unit for sizes and blocks (--block-size), 0 if unset
+
+	blockSuffix string // unit written after sizes, for --block-size=K etc.
+	groupDigits bool   // group digits in thousands, for --block-size='1
+	si          bool   // human-readable sizes in powers of 1000 (--si)
+	iec         bool   // human-readable sizes with KiB, MiB... (--iec)
+
+	numericIDs bool // print uids and gids instead of user and group names
+	noOwner    bool // leave out the owner column in long format
+	noGroup    bool // leave out the group column in long format
+
+	timeStyle string // how to show times in long format (see timeStyles)
+
+	dereference     bool // show the targets of all symlinks (-L)
+	dereferenceArgs bool // show the targets of symlink arguments (-H)
+	linkChain       bool // show every hop of symlink chains
+
+	recursive     bool     // list subdirectories recursively (-R)
+	maxDepth      int      // how deep -R goes, -1 for no limit
+	prune         []string // name patterns of directories -R skips
+	oneFileSystem bool     // don't recurse into other file systems
+
+	dirSize   bool // show the total size of everything in directories
+	count     bool // show the number of entries in directories
+	sortCount bool // sort by the number of entries in directories
+
+	top int // list only this many of the first files below the arguments
+
+	stats     string // the format of the --stats summary, "" for none
+	histogram string // what --histogram buckets by, size or mtime
+	treemap   bool   // draw a map of how much space every entry takes
+
+	location   *time.Location // time zone from --tz, nil for TZ/local time
+	monthNames []string       // month abbreviations of LC_TIME, nil for C
 }
 
 // Listings contain all the information about a file or directory in a printable
 // form.
 type Listing struct {
-	permissions  string
-	numHardLinks string
-	owner        string
-	group        string
-	size         string
-	epochNano    int64
-	month        string
-	day          string
-	time         string
-	name         string
-	linkName     string
-	linkOrphan   bool
-	isSocket     bool
-	isPipe       bool
-	isBlock      bool
-	isCharacter  bool
+	inode         string
+	blocks        string
+	blocksBytes   int64 // allocated size in bytes
+	permissions   string
+	numHardLinks  string
+	owner         string
+	group         string
+	size          string
+	sizeBytes     int64
+	epochNano     int64
+	month         string
+	day           string
+	time          string
+	name          string
+	linkName      string
+	linkOrphan    bool
+	linkTarget    *Listing // the type of the symlink target, if it exists
+	linkChain     []string // the targets after the first one (--link-chain)
+	linkLoop      bool     // the symlink chain loops
+	isSocket      bool
+	isPipe        bool
+	isBlock       bool
+	isCharacter   bool
+	hasCapability bool
+	timedOut      bool   // the metadata could not be read within --timeout
+	dev           uint64 // the device and inode number, to tell directories
+	ino           uint64 // apart when recursing
+	count         string // the number of entries in a directory (--count)
+	countEntries  int    // the same as a number, -1 for other files
+}
+
+// The output writer streams everything the program prints through a buffered
+// io.Writer.  Separators that may have to be dropped at the end of a block are
+// held back as pending bytes and are only written once more output follows, so
+// listings can be flushed as they are produced instead of trimmed afterwards.
+type outputWriter struct {
+	writer     *bufio.Writer
+	pending    string // separator bytes not yet written
+	written    bool   // whether anything has been written at all
+	lineEnded  bool   // whether endLine was the last thing written
+	err        error  // first error returned by the underlying writer
+	isTerminal bool   // whether the output goes to a terminal
 }
 
 // Global variables used by multiple functions
 var (
-	userMap  map[int]string    // matches uid to username
-	groupMap map[int]string    // matches gid to groupname
-	colorMap map[string]string // matches file specification to output color
-	options  Options           // the state of all program options
+	userMap       map[int]string    // matches uid to username
+	groupMap      map[int]string    // matches gid to groupname
+	colorMap      map[string]string // matches file specification to color
+	colorPatterns []colorPattern    // LS_COLORS file name patterns, in order
+	linkAsTarget  bool              // ln=target: color symlinks like targets
+	colorLeft     string            // lc: what every color code starts with
+	colorRight    string            // rc: what every color code ends with
+
+	currentUserName   string          // highlighted in the owner column
+	currentUserGroups map[string]bool // highlighted in the group column
+	options           Options         // the state of all program options
+
+	ownerCache     = make(map[uint32]string) // matches uid to resolved owner
+	ownerCacheLock sync.Mutex                // guards ownerCache
+
+	// --dir-size totals of directories by device and inode, and the files
+	// with several hard links counted so far, shared by the whole listing
+	dirSizeCache map[[2]uint64][2]int64
+	dirSizeSeen  map[[2]uint64]bool
+	dirSizeLock  sync.Mutex // guards dirSizeCache and dirSizeSeen
+
+	// one for every entry being stated, shared by all the directories read at
+	// once so no more than options.jobs stats are in flight (as many as there
+	// are CPUs, the default of --jobs, until ls sets it)
+	statSlots = make(chan struct{}, runtime.NumCPU())
+
+	// returned by filesystem calls that did not answer within --timeout
+	errTimedOut = errors.New("timed out")
 )
 
+// Create a new outputWriter on top of the given io.Writer.
+func newOutputWriter(w io.Writer) *outputWriter {
+	o := &outputWriter{writer: bufio.NewWriter(w)}
+	if f, ok := w.(*os.File); ok {
+		o.isTerminal = terminal.IsTerminal(int(f.Fd()))
+	}
+	return o
+}
+
+// Write a string to the output, preceded by any pending separator.  Once the
+// underlying writer has failed (e.g. a broken pipe), later writes are dropped.
+func (o *outputWriter) WriteString(s string) {
+	if o.err != nil {
+		return
+	}
+
+	s = o.pending + s
+	o.pending = ""
+	if s == "" {
+		return
+	}
+
+	_, o.err = o.writer.WriteString(s)
+	o.written = true
+	o.lineEnded = false
+}
+
+// Hold back a separator until more output is written.
+func (o *outputWriter) deferString(s string) {
+	o.pending += s
+}
+
+// Drop the last n bytes of the pending separator.
+func (o *outputWriter) trimPending(n int) {
+	if n > len(o.pending) {
+		n = len(o.pending)
+	}
+	o.pending = o.pending[:len(o.pending)-n]
+}
+
+// End the current line, so something else (like a warning on stderr) can be
+// printed after it: a pending separator that starts with a newline gives up
+// that newline, the rest of it is kept back.
+func (o *outputWriter) endLine() {
+	if strings.HasPrefix(o.pending, "\n") {
+		rest := o.pending[1:]
+		o.pending = ""
+		o.WriteString("\n")
+		o.pending = rest
+		o.lineEnded = true
+	}
+}
+
+// Flush everything written so far to the underlying writer.  Pending separators
+// are kept back.
+func (o *outputWriter) Flush() error {
+	if o.err != nil {
+		return o.err
+	}
+	o.err = o.writer.Flush()
+	return o.err
+}
+
+// Finish the output: write out anything still pending, terminate the last line
+// and flush the underlying writer.
+func (o *outputWriter) Close() error {
+	o.WriteString("")
+	if o.written && !o.lineEnded {
+		o.WriteString("\n")
+	}
+	return o.Flush()
+}
+
 // Helper function for get_color_from_bsd_code.  Given a flag to indicate
 // foreground/background and a single letter, return the correct partial ASCII
 // color code.
@@ -231,154 +424,1023 @@ func parseLscolors(LSCOLORS string) {
 	}
 }
 
-// Write the given Listing's name to the output buffer, with the appropriate
+// The two-letter LS_COLORS keys for file types, and the colorMap keys they
+// fill in.
+var lsColorsKeys = map[string]string{
+	"no": "normal",
+	"fi": "file",
+	"di": "directory",
+	"ln": "symlink",
+	"mh": "multi_hardlink",
+	"pi": "pipe",
+	"so": "socket",
+	"do": "door",
+	"bd": "block",
+	"cd": "character",
+	"or": "link_orphan",
+	"mi": "link_orphan_target",
+	"su": "executable_suid",
+	"sg": "executable_sgid",
+	"ca": "capability",
+	"tw": "directory_o+w_sticky",
+	"ow": "directory_o+w",
+	"st": "directory_sticky",
+	"ex": "executable",
+}
+
+// The colors GNU ls uses for the keys missing from LS_COLORS.
+var lsColorsDefaults = map[string]string{
+	"lc": "\x1b[",
+	"rc": "m",
+	"rs": "0",
+	"di": "01;34",
+	"ln": "01;36",
+	"pi": "33",
+	"so": "01;35",
+	"do": "01;35",
+	"bd": "01;33",
+	"cd": "01;33",
+	"ex": "01;32",
+	"su": "37;41",
+	"sg": "30;43",
+	"tw": "30;42",
+	"ow": "34;42",
+	"st": "37;44",
+}
+
+// Decode the escapes dircolors allows in LS_COLORS keys and values: backslash
+// escapes (\e, \n, \_ for a space, \033, \x1b, ...) and caret notation (^[).
+// Returns false if the string is malformed.
+func unescapeLsColors(s string) (string, bool) {
+	var unescaped bytes.Buffer
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '^' {
+			i++
+			if i == len(s) {
+				return "", false
+			} else if s[i] == '?' {
+				unescaped.WriteByte(127)
+			} else if s[i] >= '@' && s[i] <= '~' {
+				unescaped.WriteByte(s[i] & 037)
+			} else {
+				return "", false
+			}
+		} else if s[i] == '\\' {
+			i++
+			if i == len(s) {
+				return "", false
+			}
+
+			if s[i] >= '0' && s[i] <= '7' {
+				// up to three octal digits
+				value := 0
+				j := i
+				for ; j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7'; j++ {
+					value = value*8 + int(s[j]-'0')
+				}
+				unescaped.WriteByte(byte(value))
+				i = j - 1
+			} else if s[i] == 'x' {
+				// up to two hex digits
+				value := 0
+				j := i + 1
+				for ; j < len(s) && j < i+3; j++ {
+					digit, err := strconv.ParseUint(s[j:j+1], 16, 8)
+					if err != nil {
+						break
+					}
+					value = value*16 + int(digit)
+				}
+				if j == i+1 {
+					return "", false
+				}
+				unescaped.WriteByte(byte(value))
+				i = j - 1
+			} else if s[i] == 'a' {
+				unescaped.WriteByte('\a')
+			} else if s[i] == 'b' {
+				unescaped.WriteByte('\b')
+			} else if s[i] == 'e' {
+				unescaped.WriteByte(27)
+			} else if s[i] == 'f' {
+				unescaped.WriteByte('\f')
+			} else if s[i] == 'n' {
+				unescaped.WriteByte('\n')
+			} else if s[i] == 'r' {
+				unescaped.WriteByte('\r')
+			} else if s[i] == 't' {
+				unescaped.WriteByte('\t')
+			} else if s[i] == 'v' {
+				unescaped.WriteByte('\v')
+			} else if s[i] == '?' {
+				unescaped.WriteByte(127)
+			} else if s[i] == '_' {
+				unescaped.WriteByte(' ')
+			} else {
+				unescaped.WriteByte(s[i])
+			}
+		} else {
+			unescaped.WriteByte(s[i])
+		}
+	}
+
+	return unescaped.String(), true
+}
+
+// Report whether an LS_COLORS value actually sets a color.  GNU ls treats an
+// empty value, "0" and "00" as "not colored", so a less specific type applies.
+func isColored(value string) bool {
+	return value != "" && value != "0" && value != "00"
+}
+
+// Given an LS_COLORS string, fill in the appropriate keys and values of the
+// global colorMap and the list of file name patterns.  Keys missing from the
+// string keep GNU's defaults, and malformed entries are skipped rather than
+// disabling color altogether.
+func parseLsColors(LsColors string) {
+	codes := make(map[string]string)
+	for key, value := range lsColorsDefaults {
+		codes[key] = value
+	}
+	patterns := make([]colorPattern, 0)
+
+	for _, entry := range strings.Split(LsColors, ":") {
+		if entry == "" {
+			continue
+		}
+
+		equals := strings.Index(entry, "=")
+		if equals < 0 {
+			continue
+		}
+
+		key, ok := unescapeLsColors(entry[:equals])
+		if !ok || key == "" {
+			continue
+		}
+		value, ok := unescapeLsColors(entry[equals+1:])
+		if !ok {
+			continue
+		}
+
+		_, isType := lsColorsKeys[key]
+		if isType || key == "lc" || key == "rc" || key == "ec" ||
+			key == "rs" || key == "cl" {
+			codes[key] = value
+		} else {
+			// "*.ext" suffixes, other globs and exact file names
+			patterns = append(patterns, colorPattern{
+				pattern:      key,
+				patternLower: strings.ToLower(key),
+				color:        value,
+			})
+		}
+	}
+
+	colorLeft = codes["lc"]
+	colorRight = codes["rc"]
+
+	// ln=target colors symlinks like the files they point to, and with the
+	// default symlink color when the target is unknown
+	linkAsTarget = codes["ln"] == "target"
+	if linkAsTarget {
+		codes["ln"] = lsColorsDefaults["ln"]
+	}
+
+	// the escape sequences are only complete once lc and rc are known
+	for key, name := range lsColorsKeys {
+		if isColored(codes[key]) {
+			colorMap[name] = codes["lc"] + codes[key] + codes["rc"]
+		} else {
+			delete(colorMap, name)
+		}
+	}
+
+	for i := range patterns {
+		if isColored(patterns[i].color) {
+			patterns[i].color = codes["lc"] + patterns[i].color + codes["rc"]
+		} else {
+			patterns[i].color = ""
+		}
+	}
+	colorPatterns = patterns
+
+	if _, ok := codes["ec"]; ok {
+		colorMap["end"] = codes["ec"]
+	} else {
+		colorMap["end"] = codes["lc"] + codes["rs"] + codes["rc"]
+	}
+}
+
+// Report whether the given LS_COLORS pattern matches the file name.  A pattern
+// of the form "*suffix" matches the end of the name (e.g. "*.tar.gz"), other
+// patterns with wildcards are globs and anything else must match exactly.
+func matchColorPattern(p colorPattern, name string, foldCase bool) bool {
+	pattern := p.pattern
+	if foldCase {
+		pattern = p.patternLower
+		name = strings.ToLower(name)
+	}
+
+	if pattern[0] == '*' && !strings.ContainsAny(pattern[1:], "*?[") {
+		return strings.HasSuffix(name, pattern[1:])
+	} else if strings.ContainsAny(pattern, "*?[") {
+		matched, err := filepath.Match(pattern, filepath.Base(name))
+		return err == nil && matched
+	}
+
+	return filepath.Base(name) == pattern
+}
+
+// Return the color of the LS_COLORS pattern matching the given name.  As in GNU
+// ls, later patterns take precedence over earlier ones, and a case-sensitive
+// match takes precedence over a case-insensitive one.
+func getPatternColor(name string) (string, bool) {
+	for i := len(colorPatterns) - 1; i >= 0; i-- {
+		if matchColorPattern(colorPatterns[i], name, false) {
+			return colorPatterns[i].color, true
+		}
+	}
+	for i := len(colorPatterns) - 1; i >= 0; i-- {
+		if matchColorPattern(colorPatterns[i], name, true) {
+			return colorPatterns[i].color, true
+		}
+	}
+
+	return "", false
+}
+
+// Return the color code for the given Listing, or "" if it isn't colored.  This
+// follows the GNU ls precedence: the most specific type that has a color wins
+// (e.g. setuid over executable over multiple hard links), and file name
+// patterns only apply to regular files that have no more specific type.
+func getListingColor(l Listing) string {
+	numHardlinks, _ := strconv.Atoi(l.numHardLinks)
+
+	colorKey := "normal"
+	if l.permissions[0] == 'd' {
+		colorKey = "directory"
+		if l.permissions[8] == 'w' && l.permissions[9] == 't' &&
+			colorMap["directory_o+w_sticky"] != "" {
+			colorKey = "directory_o+w_sticky"
+		} else if l.permissions[8] == 'w' && colorMap["directory_o+w"] != "" {
+			colorKey = "directory_o+w"
+		} else if l.permissions[9] == 't' &&
+			colorMap["directory_sticky"] != "" {
+			colorKey = "directory_sticky"
+		}
+	} else if l.permissions[0] == 'l' {
+		colorKey = "symlink"
+		if l.linkOrphan && colorMap["link_orphan"] != "" {
+			colorKey = "link_orphan"
+		} else if linkAsTarget && l.linkTarget != nil {
+			return getListingColor(*l.linkTarget)
+		}
+	} else if l.isSocket {
+		colorKey = "socket"
+	} else if l.isPipe {
+		colorKey = "pipe"
+	} else if l.isBlock {
+		colorKey = "block"
+	} else if l.isCharacter {
+		colorKey = "character"
+	} else if l.permissions[0] == '-' {
+		colorKey = "file"
+		if l.permissions[3] == 's' && colorMap["executable_suid"] != "" {
+			colorKey = "executable_suid"
+		} else if l.permissions[6] == 's' &&
+			colorMap["executable_sgid"] != "" {
+			colorKey = "executable_sgid"
+		} else if l.hasCapability && colorMap["capability"] != "" {
+			colorKey = "capability"
+		} else if strings.Contains(l.permissions, "x") &&
+			colorMap["executable"] != "" {
+			colorKey = "executable"
+		} else if numHardlinks > 1 && colorMap["multi_hardlink"] != "" {
+			colorKey = "multi_hardlink"
+		}
+	}
+
+	if colorKey == "file" {
+		if color, ok := getPatternColor(l.name); ok {
+			return color
+		}
+	}
+
+	if colorMap[colorKey] == "" {
+		return colorMap["normal"]
+	}
+	return colorMap[colorKey]
+}
+
+// The columns that --color-columns can color.
+var colorColumnNames = []string{"perms", "size", "age", "owner"}
+
+// The default colors for --color-columns.  A theme can override them in its
+// [columns] table (e.g. `perm_read = "yellow"`), and an empty style turns the
+// coloring of that part off.
+var columnColorsDefaults = map[string]string{
+	"column_perm_type":    "\x1b[1;34m",
+	"column_perm_read":    "\x1b[0;33m",
+	"column_perm_write":   "\x1b[0;31m",
+	"column_perm_exec":    "\x1b[0;32m",
+	"column_perm_special": "\x1b[0;35m",
+	"column_perm_none":    "",
+	"column_size_bytes":   "\x1b[0;32m",
+	"column_size_kilo":    "\x1b[1;32m",
+	"column_size_mega":    "\x1b[1;33m",
+	"column_size_giga":    "\x1b[1;31m",
+	"column_age_hour":     "\x1b[1;34m",
+	"column_age_day":      "\x1b[0;34m",
+	"column_age_month":    "\x1b[0;36m",
+	"column_age_old":      "\x1b[0;90m",
+	"column_owner_self":   "\x1b[1;33m",
+	"column_group_self":   "\x1b[0;33m",
+}
+
+// Write text to the output in the given color, or plain if color is "".
+func writeColored(output *outputWriter, text string, color string) {
+	if color == "" {
+		output.WriteString(text)
+		return
+	}
+
+	output.WriteString(color)
+	output.WriteString(text)
+	output.WriteString(colorMap["end"])
+}
+
+// Write a permissions string like "drwxr-sr-x" to the output, with every
+// character colored by its class: the file type, read, write, execute, the
+// setuid/setgid/sticky bits and unset bits.
+func writePermissions(output *outputWriter, permissions string) {
+	for i, c := range permissions {
+		colorKey := "column_perm_none"
+		if i == 0 && c != '-' {
+			colorKey = "column_perm_type"
+		} else if c == 'r' {
+			colorKey = "column_perm_read"
+		} else if c == 'w' {
+			colorKey = "column_perm_write"
+		} else if c == 'x' {
+			colorKey = "column_perm_exec"
+		} else if c == 's' || c == 'S' || c == 't' || c == 'T' {
+			colorKey = "column_perm_special"
+		}
+
+		writeColored(output, string(c), colorMap[colorKey])
+	}
+}
+
+// Return the color of the size column for the given Listing, shaded by the
+// magnitude of the size.
+func getSizeColor(l Listing) string {
+	if l.timedOut {
+		return ""
+	} else if l.sizeBytes < 1024 {
+		return colorMap["column_size_bytes"]
+	} else if l.sizeBytes < 1024*1024 {
+		return colorMap["column_size_kilo"]
+	} else if l.sizeBytes < 1024*1024*1024 {
+		return colorMap["column_size_mega"]
+	}
+
+	return colorMap["column_size_giga"]
+}
+
+// Return the color of the timestamp columns for the given Listing, shaded by
+// how long ago it was modified.
+func getAgeColor(l Listing) string {
+	if l.timedOut {
+		return ""
+	}
+
+	age := time.Since(time.Unix(0, l.epochNano))
+	if age < time.Hour {
+		return colorMap["column_age_hour"]
+	} else if age < 24*time.Hour {
+		return colorMap["column_age_day"]
+	} else if age < 30*24*time.Hour {
+		return colorMap["column_age_month"]
+	}
+
+	return colorMap["column_age_old"]
+}
+
+// Look up the current user and their groups, for highlighting them in the
+// owner and group columns.
+func loadCurrentUser() {
+	currentUserGroups = make(map[string]bool)
+
+	current, err := user.Current()
+	if err != nil {
+		return
+	}
+	currentUserName = current.Username
+	if options.numericIDs {
+		currentUserName = current.Uid
+	}
+
+	groupIds, err := current.GroupIds()
+	if err != nil {
+		groupIds = []string{current.Gid}
+	}
+	for _, gid := range groupIds {
+		_gid, err := strconv.Atoi(gid)
+		if err != nil {
+			continue
+		}
+		if groupMap[_gid] != "" && !options.numericIDs {
+			currentUserGroups[groupMap[_gid]] = true
+		} else {
+			currentUserGroups[gid] = true
+		}
+	}
+}
+
+// Write the given Listing's name to the output, with the appropriate
 // formatting based on the current options.
-func writeListingName(outputBuffer *bytes.Buffer, l Listing) {
+func writeListingName(output *outputWriter, l Listing) {
 
 	if options.color {
-		appliedColor := false
-
-		numHardlinks, _ := strconv.Atoi(l.numHardLinks)
-
-		// "file.name.txt" -> "*.txt"
-		nameSplit := strings.Split(l.name, ".")
-		extensionStr := ""
-		if len(nameSplit) > 1 {
-			extensionStr = fmt.Sprintf("*.%s", nameSplit[len(nameSplit)-1])
-		}
-
-		if extensionStr != "" && colorMap[extensionStr] != "" {
-			outputBuffer.WriteString(colorMap[extensionStr])
-			appliedColor = true
-		} else if l.permissions[0] == 'd' &&
-			l.permissions[8] == 'w' && l.permissions[9] == 't' {
-			outputBuffer.WriteString(colorMap["directory_o+w_sticky"])
-			appliedColor = true
-		} else if l.permissions[0] == 'd' && l.permissions[9] == 't' {
-			outputBuffer.WriteString(colorMap["directory_sticky"])
-			appliedColor = true
-		} else if l.permissions[0] == 'd' && l.permissions[8] == 'w' {
-			outputBuffer.WriteString(colorMap["directory_o+w"])
-			appliedColor = true
-		} else if l.permissions[0] == 'd' { // directory
-			outputBuffer.WriteString(colorMap["directory"])
-			appliedColor = true
-		} else if numHardlinks > 1 { // multiple hardlinks
-			outputBuffer.WriteString(colorMap["multi_hardlink"])
-			appliedColor = true
-		} else if l.permissions[0] == 'l' && l.linkOrphan { // orphan link
-			outputBuffer.WriteString(colorMap["link_orphan"])
-			appliedColor = true
-		} else if l.permissions[0] == 'l' { // symlink
-			outputBuffer.WriteString(colorMap["symlink"])
-			appliedColor = true
-		} else if l.permissions[3] == 's' { // setuid
-			outputBuffer.WriteString(colorMap["executable_suid"])
-			appliedColor = true
-		} else if l.permissions[6] == 's' { // setgid
-			outputBuffer.WriteString(colorMap["executable_sgid"])
-			appliedColor = true
-		} else if strings.Contains(l.permissions, "x") { // executable
-			outputBuffer.WriteString(colorMap["executable"])
-			appliedColor = true
-		} else if l.isSocket { // socket
-			outputBuffer.WriteString(colorMap["socket"])
-			appliedColor = true
-		} else if l.isPipe { // pipe
-			outputBuffer.WriteString(colorMap["pipe"])
-			appliedColor = true
-		} else if l.isBlock { // block
-			outputBuffer.WriteString(colorMap["block"])
-			appliedColor = true
-		} else if l.isCharacter { // character
-			outputBuffer.WriteString(colorMap["character"])
-			appliedColor = true
-		}
-
-		outputBuffer.WriteString(l.name)
-		if appliedColor {
-			outputBuffer.WriteString(colorMap["end"])
+		color := getListingColor(l)
+
+		output.WriteString(color)
+		output.WriteString(quoteName(l.name))
+		if color != "" {
+			output.WriteString(colorMap["end"])
 		}
 	} else {
-		outputBuffer.WriteString(l.name)
+		output.WriteString(quoteName(l.name))
 	}
 
 	if l.permissions[0] == 'l' && options.long {
-		if l.linkOrphan {
-			outputBuffer.WriteString(fmt.Sprintf(" -> %s%s%s",
-				colorMap["link_orphan_target"],
-				l.linkName,
-				colorMap["end"]))
+		// with --link-chain, the intermediate symlinks come before the final
+		// target
+		targets := append([]string{l.linkName}, l.linkChain...)
+		for i, target := range targets {
+			output.WriteString(" -> ")
+			if !options.color {
+				output.WriteString(quoteName(target))
+			} else if i < len(targets)-1 {
+				writeColored(output, quoteName(target), colorMap["symlink"])
+			} else if l.linkOrphan {
+				writeColored(output, quoteName(target),
+					colorMap["link_orphan_target"])
+			} else if l.linkTarget != nil {
+				// color the target by its own type
+				writeColored(output, quoteName(target),
+					getListingColor(*l.linkTarget))
+			} else {
+				output.WriteString(quoteName(target))
+			}
+		}
+
+		if options.linkChain && l.linkLoop {
+			output.WriteString(" [loop]")
+		} else if options.linkChain && l.linkOrphan {
+			output.WriteString(" [orphan]")
+		}
+	}
+}
+
+// Return the indicator that --indicator-style appends to the given Listing's
+// name: '/' for directories, '*' for executables, '@' for symlinks, '|' for
+// pipes and '=' for sockets.  In long format, symlinks get no indicator, since
+// they are already followed by their target.
+func getIndicator(l Listing) string {
+	style := options.indicatorStyle
+	if style == "none" || style == "" || l.timedOut {
+		return ""
+	}
+
+	if l.permissions[0] == 'd' {
+		return "/"
+	} else if style == "slash" {
+		return ""
+	}
+
+	if l.permissions[0] == 'l' && !options.long {
+		return "@"
+	} else if l.isPipe {
+		return "|"
+	} else if l.isSocket {
+		return "="
+	} else if style == "classify" && l.permissions[0] == '-' &&
+		(strings.ContainsAny(l.permissions[3:4], "xs") ||
+			strings.ContainsAny(l.permissions[6:7], "xs") ||
+			strings.ContainsAny(l.permissions[9:10], "xt")) {
+		return "*"
+	}
+
+	return ""
+}
+
+// Run the given blocking filesystem call, giving up once ctx is done or the
+// --timeout for a single call elapses.  A call that gives up is left running in
+// the background, since a stat hung on a stale mount cannot be interrupted.
+func callWithTimeout(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	callCtx := ctx
+	if options.timeout > 0 {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithTimeout(ctx, options.timeout)
+		defer cancel()
+	}
+
+	// nothing can interrupt the call, so just make it directly
+	if callCtx.Done() == nil {
+		return call()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-callCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errTimedOut
+	}
+}
+
+// Lstat the given path, bounded by ctx and --timeout.
+func lstatContext(ctx context.Context, path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := callWithTimeout(ctx, func() error {
+		var err error
+		info, err = os.Lstat(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Stat the given path, bounded by ctx and --timeout.
+func statContext(ctx context.Context, path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := callWithTimeout(ctx, func() error {
+		var err error
+		info, err = os.Stat(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Report whether the file at path has file capabilities, bounded by ctx and
+// --timeout.  A check that gives up counts as no capabilities.
+func hasCapabilityContext(ctx context.Context, path string) bool {
+	found := false
+	err := callWithTimeout(ctx, func() error {
+		found = hasCapability(path)
+		return nil
+	})
+
+	// found is only safe to read once the call has returned
+	return err == nil && found
+}
+
+// Return the directory a path is in with every symlink in it resolved, bounded
+// by ctx and --timeout, or the directory as it is written if that fails.
+func getRealDir(ctx context.Context, path string) string {
+	dir := filepath.Dir(path)
+	realDir := dir
+	err := callWithTimeout(ctx, func() error {
+		var err error
+		realDir, err = filepath.EvalSymlinks(dir)
+		return err
+	})
+	if err != nil {
+		return dir
+	}
+
+	return realDir
+}
+
+// Follow the symlink at path, whose target is link, for --link-chain.  Return
+// the targets of the symlinks after the first one, as they are written in each
+// link, and whether the chain loops.  Relative targets are resolved against
+// the real directory of the link they come from, the way the kernel does (so a
+// ".." after a symlinked directory leads to the parent of its target).
+func resolveLinkChain(ctx context.Context, path string,
+	link string) ([]string, bool) {
+	chain := make([]string, 0)
+	dir := getRealDir(ctx, path)
+	visited := map[string]bool{filepath.Join(dir, filepath.Base(path)): true}
+
+	for {
+		// not cleaned, as ".." only means the parent once the kernel has
+		// followed the symlinks before it
+		if filepath.IsAbs(link) {
+			path = link
 		} else {
-			outputBuffer.WriteString(fmt.Sprintf(" -> %s", l.linkName))
+			path = dir + "/" + link
+		}
+		dir = getRealDir(ctx, path)
+
+		// the kernel gives up after 40 links as well
+		key := filepath.Join(dir, filepath.Base(path))
+		if visited[key] || len(chain) >= 40 {
+			return chain, true
+		}
+		visited[key] = true
+
+		info, err := lstatContext(ctx, path)
+		if err != nil || info.Mode()&os.ModeSymlink != os.ModeSymlink {
+			// the final target, or an orphan
+			return chain, false
+		}
+
+		err = callWithTimeout(ctx, func() error {
+			var err error
+			link, err = os.Readlink(path)
+			return err
+		})
+		if err != nil {
+			return chain, false
+		}
+		chain = append(chain, link)
+	}
+}
+
+// Add up the apparent size and the allocated size of a directory and everything
+// below it, given its own device, inode and sizes, like du does: hard linked
+// files are only counted once in the whole listing, symlinks aren't followed
+// and, with --one-file-system, other file systems are left out.
+// Subdirectories that can't be read (or time out) are skipped.  Every total
+// is kept in dirSizeCache, so each directory is only read once, and the caller
+// must hold dirSizeLock.
+func getDirSize(ctx context.Context, path string, dev uint64, ino uint64,
+	apparent int64, allocated int64) (int64, int64) {
+	key := [2]uint64{dev, ino}
+	if total, ok := dirSizeCache[key]; ok {
+		return total[0], total[1]
+	}
+	// a directory that (through a bind mount) contains itself adds nothing
+	dirSizeCache[key] = [2]int64{0, 0}
+
+	var entries []os.FileInfo
+	callWithTimeout(ctx, func() error {
+		dirFile, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer dirFile.Close()
+
+		entries, err = dirFile.Readdir(-1)
+		return err
+	})
+
+	for _, entry := range entries {
+		stat, ok := entry.Sys().(*syscall.Stat_t)
+		if !ok || (options.oneFileSystem && uint64(stat.Dev) != dev) {
+			continue
 		}
+
+		if entry.IsDir() {
+			entryApparent, entryAllocated := getDirSize(ctx,
+				path+"/"+entry.Name(), uint64(stat.Dev), uint64(stat.Ino),
+				entry.Size(), int64(stat.Blocks)*512)
+			apparent += entryApparent
+			allocated += entryAllocated
+			continue
+		}
+
+		// count a file only once, however many hard links lead to it
+		if stat.Nlink > 1 {
+			entryKey := [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}
+			if dirSizeSeen[entryKey] {
+				continue
+			}
+			dirSizeSeen[entryKey] = true
+		}
+		apparent += entry.Size()
+		allocated += int64(stat.Blocks) * 512
+	}
+
+	dirSizeCache[key] = [2]int64{apparent, allocated}
+	return apparent, allocated
+}
+
+// Replace the sizes of the directories among the given listings of dirname
+// ("" for command line arguments) with the sizes of everything below them, for
+// --dir-size.  The listings are done one at a time, in order, so a file hard
+// linked from several directories is always counted in the same one.
+func setDirSizes(ctx context.Context, dirname string, listings []Listing) {
+	dirSizeLock.Lock()
+	defer dirSizeLock.Unlock()
+
+	for i, l := range listings {
+		if l.permissions[0] != 'd' || l.timedOut || l.name == ".." {
+			continue
+		}
+
+		path := l.name
+		if dirname != "" {
+			path = dirname + "/" + l.name
+		}
+		apparent, allocated := getDirSize(ctx, path, l.dev, l.ino,
+			l.sizeBytes, l.blocksBytes)
+		listings[i].size = formatSize(apparent)
+		listings[i].sizeBytes = apparent
+		listings[i].blocks = formatBlocks(allocated)
+		listings[i].blocksBytes = allocated
 	}
 }
 
+// Stat a path to list it.  With follow set (for -L, or -H on the command line),
+// symlinks are followed so the listing shows their target; broken symlinks are
+// still listed as themselves.
+func statListing(ctx context.Context, path string,
+	follow bool) (os.FileInfo, error) {
+	if follow {
+		info, err := statContext(ctx, path)
+		if err == nil || err == errTimedOut || ctx.Err() != nil {
+			return info, err
+		}
+	}
+
+	return lstatContext(ctx, path)
+}
+
+// Create a placeholder Listing for an entry whose metadata could not be read
+// within --timeout.  Everything but the name shows up as "?" in long format.
+func createTimedOutListing(name string) Listing {
+	return Listing{
+		inode:        "?",
+		blocks:       "?",
+		permissions:  "??????????",
+		numHardLinks: "?",
+		owner:        "?",
+		group:        "?",
+		size:         "?",
+		count:        "?",
+		countEntries: -1,
+		month:        "?",
+		day:          "?",
+		time:         "?",
+		name:         name,
+		timedOut:     true,
+	}
+}
+
+// Return the name of the user with the given uid.  Lookups can be slow (e.g.
+// with remote NSS), so every uid is only resolved once and then cached.
+func lookupOwner(uid uint32) string {
+	ownerCacheLock.Lock()
+	owner, ok := ownerCache[uid]
+	ownerCacheLock.Unlock()
+	if ok {
+		return owner
+	}
+
+	_owner, err := user.LookupId(fmt.Sprintf("%d", uid))
+	if err != nil {
+		// if this causes an error, use the manual user_map
+		//
+		// this can happen if go is built using cross-compilation for multiple
+		// architectures (such as with Fedora Linux), in which case these
+		// OS-specific features aren't implemented
+		owner = userMap[int(uid)]
+		if owner == "" {
+			// if the user isn't in the map, just use the uid number
+			owner = fmt.Sprintf("%d", uid)
+		}
+	} else {
+		owner = _owner.Username
+	}
+
+	ownerCacheLock.Lock()
+	ownerCache[uid] = owner
+	ownerCacheLock.Unlock()
+
+	return owner
+}
+
+// Write a number with its digits grouped in thousands if --block-size asks for
+// it, e.g. 1234567 -> 1,234,567.  The grouping is always that of the C locale,
+// a comma every three digits: the separator of LC_NUMERIC isn't looked up.
+func formatNumber(n int64) string {
+	digits := fmt.Sprintf("%d", n)
+	if !options.groupDigits {
+		return digits
+	}
+
+	grouped := ""
+	for i := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 && digits[i-1] != '-' {
+			grouped += ","
+		}
+		grouped += digits[i : i+1]
+	}
+
+	return grouped
+}
+
+// Return a size in bytes the way it should be displayed: with a unit suffix
+// for -h and --si, in units of --block-size if given, or as a plain number of
+// bytes.
+func formatSize(bytes int64) string {
+	if options.human {
+		return formatHumanSize(bytes)
+	} else if options.blockSize > 0 {
+		return formatNumber((bytes+options.blockSize-1)/options.blockSize) +
+			options.blockSuffix
+	}
+
+	return formatNumber(bytes)
+}
+
+// Return an allocated size in bytes the way -s and the total line show it: with
+// a unit suffix for -h and --si, otherwise in units of --block-size (1024 by
+// default).
+func formatBlocks(bytes int64) string {
+	if options.human {
+		return formatHumanSize(bytes)
+	}
+
+	blockSize := options.blockSize
+	if blockSize == 0 {
+		blockSize = 1024
+	}
+
+	return formatNumber((bytes+blockSize-1)/blockSize) + options.blockSuffix
+}
+
+// Format a size in bytes with a unit suffix, e.g. 14336 -> 14K.  With --si the
+// units are powers of 1000 (14k), with --iec they are written as KiB, MiB...
+func formatHumanSize(bytes int64) string {
+	base := 1024.0
+	if options.si {
+		base = 1000.0
+	}
+
+	size := float64(bytes)
+
+	count := 0
+	for size >= 1.0 {
+		size /= base
+		count++
+	}
+
+	if count < 0 {
+		count = 0
+	} else if count > 0 {
+		size *= base
+		count--
+	}
+
+	var suffix string
+	if count == 0 {
+		suffix = "B"
+	} else if count == 1 && options.si {
+		suffix = "k"
+	} else if count <= 6 {
+		suffix = string("KMGTPE"[count-1])
+	} else {
+		suffix = "?"
+	}
+	if count > 0 && options.iec {
+		suffix = strings.ToUpper(suffix) + "iB"
+	}
+
+	sizeStr := ""
+	if count == 0 {
+		sizeB := int64(size)
+		sizeStr = fmt.Sprintf("%d%s", sizeB, suffix)
+	} else {
+		// looks like the printf formatting automatically rounds up
+		sizeStr = fmt.Sprintf("%.1f%s", size, suffix)
+	}
+
+	// drop the trailing .0 if it exists in the size
+	// e.g. 14.0K -> 14K
+	if strings.HasSuffix(sizeStr, ".0"+suffix) {
+		sizeStr = strings.TrimSuffix(sizeStr, ".0"+suffix) + suffix
+	}
+
+	return sizeStr
+}
+
+// Convert a file mode to the permissions string of the long format, like
+// "drwxr-sr-x".  Go writes some file types and the setuid, setgid and sticky
+// bits differently (e.g. "ugrwxr-xr-x"), so those are rearranged the way ls
+// writes them.
+func formatPermissions(mode os.FileMode) string {
+	permissions := mode.String()
+	if permissions[0] == 'L' {
+		permissions = strings.Replace(permissions, "L", "l", 1)
+	} else if permissions[0] == 'D' {
+		permissions = permissions[1:]
+	} else if permissions[0:2] == "ug" {
+		permissions = strings.Replace(permissions, "ug", "-", 1)
+		permissions = fmt.Sprintf("%ss%ss%s",
+			permissions[0:3], permissions[4:6], permissions[7:])
+	} else if permissions[0] == 'u' {
+		permissions = strings.Replace(permissions, "u", "-", 1)
+		permissions = fmt.Sprintf("%ss%s", permissions[0:3], permissions[4:])
+	} else if permissions[0] == 'g' {
+		permissions = strings.Replace(permissions, "g", "-", 1)
+		permissions = fmt.Sprintf("%ss%s", permissions[0:6], permissions[7:])
+	} else if permissions[0:2] == "dt" {
+		permissions = strings.Replace(permissions, "dt", "d", 1)
+		permissions = fmt.Sprintf("%st", permissions[0:len(permissions)-1])
+	}
+
+	return permissions
+}
+
+// Set the file type flags of a Listing (character or block device, pipe or
+// socket) from its file mode.
+func setFileType(l *Listing, mode os.FileMode) {
+	if mode&os.ModeCharDevice == os.ModeCharDevice { // character?
+		l.isCharacter = true
+	} else if mode&os.ModeDevice == os.ModeDevice { // block?
+		l.isBlock = true
+	} else if mode&os.ModeNamedPipe == os.ModeNamedPipe { // pipe?
+		l.isPipe = true
+	} else if mode&os.ModeSocket == os.ModeSocket { // socket?
+		l.isSocket = true
+	}
+}
+
+// Return a Listing with just the type of a symlink target, which is all that is
+// needed to color the "-> target" part by the target's own type.
+func createTargetListing(name string, info os.FileInfo) Listing {
+	target := Listing{name: name}
+	target.permissions = formatPermissions(info.Mode())
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		target.numHardLinks = fmt.Sprintf("%d", stat.Nlink)
+	}
+	setFileType(&target, info.Mode())
+
+	return target
+}
+
 // Convert a FileInfoPath object to a Listing.  The dirname is passed for
-// following symlinks.
-func createListing(dirname string, fip FileInfoPath) (Listing, error) {
+// following symlinks, which is bounded by ctx and --timeout.
+func createListing(ctx context.Context, dirname string,
+	fip FileInfoPath) (Listing, error) {
 	var currentListing Listing
 
 	// permissions string
-	currentListing.permissions = fip.info.Mode().String()
+	currentListing.permissions = formatPermissions(fip.info.Mode())
 	if fip.info.Mode()&os.ModeSymlink == os.ModeSymlink {
-		currentListing.permissions = strings.Replace(
-			currentListing.permissions, "L", "l", 1)
-
 		var _pathstr string
 		if dirname == "" {
 			_pathstr = fmt.Sprintf("%s", fip.path)
 		} else {
 			_pathstr = fmt.Sprintf("%s/%s", dirname, fip.path)
 		}
-		link, err := os.Readlink(fmt.Sprintf(_pathstr))
+		var link string
+		err := callWithTimeout(ctx, func() error {
+			var err error
+			link, err = os.Readlink(fmt.Sprintf(_pathstr))
+			return err
+		})
 		if err != nil {
 			return currentListing, err
 		}
 		currentListing.linkName = link
 
-		// check to see if the symlink target exists
-		var linkPathstr string
-		if dirname == "" {
-			linkPathstr = fmt.Sprintf("%s", link)
-		} else {
-			linkPathstr = fmt.Sprintf("%s/%s", dirname, link)
+		finalLink := link
+		if options.linkChain && options.long {
+			currentListing.linkChain, currentListing.linkLoop =
+				resolveLinkChain(ctx, _pathstr, link)
+			if len(currentListing.linkChain) > 0 {
+				finalLink = currentListing.linkChain[len(
+					currentListing.linkChain)-1]
+			}
+		}
+
+		// check to see if the symlink target exists, and what it is; stat
+		// follows the link relative to its own directory
+		targetInfo, err := statContext(ctx, _pathstr)
+		if err == nil {
+			target := createTargetListing(finalLink, targetInfo)
+			currentListing.linkTarget = &target
+		} else if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			currentListing.linkOrphan = true
+		} else if errors.Is(err, syscall.ELOOP) {
+			currentListing.linkOrphan = true
+			currentListing.linkLoop = true
+		} else if err != errTimedOut && !os.IsPermission(err) {
+			return currentListing, err
 		}
-		_, err = os.Open(linkPathstr)
-		if err != nil {
-			if os.IsNotExist(err) {
-				currentListing.linkOrphan = true
-			} else {
-				return currentListing, err
-			}
-		}
-	} else if currentListing.permissions[0] == 'D' {
-		currentListing.permissions = currentListing.permissions[1:]
-	} else if currentListing.permissions[0:2] == "ug" {
-		currentListing.permissions =
-			strings.Replace(currentListing.permissions, "ug", "-", 1)
-		currentListing.permissions = fmt.Sprintf("%ss%ss%s",
-			currentListing.permissions[0:3],
-			currentListing.permissions[4:6],
-			currentListing.permissions[7:])
-	} else if currentListing.permissions[0] == 'u' {
-		currentListing.permissions =
-			strings.Replace(currentListing.permissions, "u", "-", 1)
-		currentListing.permissions = fmt.Sprintf("%ss%s",
-			currentListing.permissions[0:3],
-			currentListing.permissions[4:])
-	} else if currentListing.permissions[0] == 'g' {
-		currentListing.permissions =
-			strings.Replace(currentListing.permissions, "g", "-", 1)
-		currentListing.permissions = fmt.Sprintf("%ss%s",
-			currentListing.permissions[0:6],
-			currentListing.permissions[7:])
-	} else if currentListing.permissions[0:2] == "dt" {
-		currentListing.permissions =
-			strings.Replace(currentListing.permissions, "dt", "d", 1)
-		currentListing.permissions = fmt.Sprintf("%st",
-			currentListing.permissions[0:len(currentListing.permissions)-1])
 	}
 
 	sys := fip.info.Sys()
@@ -388,32 +1450,24 @@ func createListing(dirname string, fip FileInfoPath) (Listing, error) {
 		return currentListing, fmt.Errorf("syscall failed\n")
 	}
 
+	currentListing.dev = uint64(stat.Dev)
+	currentListing.ino = uint64(stat.Ino)
+
 	// number of hard links
 	numHardLinks := uint64(stat.Nlink)
 	currentListing.numHardLinks = fmt.Sprintf("%d", numHardLinks)
 
 	// owner
-	owner, err := user.LookupId(fmt.Sprintf("%d", stat.Uid))
-	if err != nil {
-		// if this causes an error, use the manual user_map
-		//
-		// this can happen if go is built using cross-compilation for multiple
-		// architectures (such as with Fedora Linux), in which case these
-		// OS-specific features aren't implemented
-		_owner := userMap[int(stat.Uid)]
-		if _owner == "" {
-			// if the user isn't in the map, just use the uid number
-			currentListing.owner = fmt.Sprintf("%d", stat.Uid)
-		} else {
-			currentListing.owner = _owner
-		}
+	if options.numericIDs {
+		// skip the lookup, which can be slow with remote NSS
+		currentListing.owner = fmt.Sprintf("%d", stat.Uid)
 	} else {
-		currentListing.owner = owner.Username
+		currentListing.owner = lookupOwner(stat.Uid)
 	}
 
 	// group
 	_group := groupMap[int(stat.Gid)]
-	if _group == "" {
+	if _group == "" || options.numericIDs {
 		// if the group isn't in the map, just use the gid number
 		currentListing.group = fmt.Sprintf("%d", stat.Gid)
 	} else {
@@ -421,105 +1475,82 @@ func createListing(dirname string, fip FileInfoPath) (Listing, error) {
 	}
 
 	// size
-	if options.human {
-		size := float64(fip.info.Size())
-
-		count := 0
-		for size >= 1.0 {
-			size /= 1024
-			count++
-		}
-
-		if count < 0 {
-			count = 0
-		} else if count > 0 {
-			size *= 1024
-			count--
-		}
-
-		var suffix string
-		if count == 0 {
-			suffix = "B"
-		} else if count == 1 {
-			suffix = "K"
-		} else if count == 2 {
-			suffix = "M"
-		} else if count == 3 {
-			suffix = "G"
-		} else if count == 4 {
-			suffix = "T"
-		} else if count == 5 {
-			suffix = "P"
-		} else if count == 6 {
-			suffix = "E"
+	currentListing.size = formatSize(fip.info.Size())
+	currentListing.sizeBytes = fip.info.Size()
+
+	// inode and allocated blocks (st_blocks is in 512-byte units)
+	currentListing.inode = fmt.Sprintf("%d", stat.Ino)
+	currentListing.blocksBytes = int64(stat.Blocks) * 512
+	currentListing.blocks = formatBlocks(currentListing.blocksBytes)
+
+	// the size of everything in a directory (--dir-size) and the number of
+	// entries in it (--count); ".." would mean the whole parent, so it's left
+	// alone
+	currentListing.count = "-"
+	currentListing.countEntries = -1
+	if fip.info.IsDir() && fip.path != ".." {
+		var _pathstr string
+		if dirname == "" {
+			_pathstr = fip.path
 		} else {
-			suffix = "?"
+			_pathstr = dirname + "/" + fip.path
 		}
 
-		sizeStr := ""
-		if count == 0 {
-			sizeB := int64(size)
-			sizeStr = fmt.Sprintf("%d%s", sizeB, suffix)
-		} else {
-			// looks like the printf formatting automatically rounds up
-			sizeStr = fmt.Sprintf("%.1f%s", size, suffix)
-		}
+		if options.count || options.sortCount {
+			var names []string
+			err := callWithTimeout(ctx, func() error {
+				dirFile, err := os.Open(_pathstr)
+				if err != nil {
+					return err
+				}
+				defer dirFile.Close()
 
-		// drop the trailing .0 if it exists in the size
-		// e.g. 14.0K -> 14K
-		if len(sizeStr) > 3 &&
-			sizeStr[len(sizeStr)-3:len(sizeStr)-1] == ".0" {
-			sizeStr = sizeStr[0:len(sizeStr)-3] + suffix
+				names, err = dirFile.Readdirnames(-1)
+				return err
+			})
+			if err == nil {
+				// the entries listing the directory shows, apart from . and
+				// .. with -a
+				count := 0
+				for _, name := range names {
+					if isListedName(name) {
+						count++
+					}
+				}
+				currentListing.count = fmt.Sprintf("%d", count)
+				currentListing.countEntries = count
+			} else {
+				currentListing.count = "?"
+			}
 		}
-
-		currentListing.size = sizeStr
-
-	} else {
-		currentListing.size = fmt.Sprintf("%d", fip.info.Size())
 	}
 
 	// epoch_nano
 	currentListing.epochNano = fip.info.ModTime().UnixNano()
 
-	// month
-	currentListing.month = fip.info.ModTime().Month().String()[0:3]
-
-	// day
-	currentListing.day = fmt.Sprintf("%02d", fip.info.ModTime().Day())
-
-	// time
-	// if older than six months, print the year
-	// otherwise, print hour:minute
-	epochNow := time.Now().Unix()
-	var secondsInSixMonths int64 = 182 * 24 * 60 * 60
-	epochSixMonthsAgo := epochNow - secondsInSixMonths
-	epochModified := fip.info.ModTime().Unix()
-
-	var timeStr string
-	if epochModified <= epochSixMonthsAgo ||
-		epochModified >= (epochNow+5) {
-		timeStr = fmt.Sprintf("%d", fip.info.ModTime().Year())
-	} else {
-		timeStr = fmt.Sprintf("%02d:%02d",
-			fip.info.ModTime().Hour(),
-			fip.info.ModTime().Minute())
-	}
-
-	currentListing.time = timeStr
+	// month, day and time
+	// in the default style, older than six months shows the year instead of
+	// hour:minute
+	currentListing.month, currentListing.day, currentListing.time =
+		formatListingTime(fip.info.ModTime(), time.Now())
 
 	currentListing.name = fip.path
 
-	// character?
-	if fip.info.Mode()&os.ModeCharDevice == os.ModeCharDevice {
-		currentListing.isCharacter = true
-	} else if fip.info.Mode()&os.ModeDevice == os.ModeDevice { // block?
-		currentListing.isBlock = true
-	} else if fip.info.Mode()&os.ModeNamedPipe == os.ModeNamedPipe { // pipe?
-		currentListing.isPipe = true
-	} else if fip.info.Mode()&os.ModeSocket == os.ModeSocket { // socket?
-		currentListing.isSocket = true
+	// file capabilities are an extra lookup, so only check them if they
+	// will be colored
+	if fip.info.Mode().IsRegular() && colorMap["capability"] != "" {
+		if dirname == "" {
+			currentListing.hasCapability =
+				hasCapabilityContext(ctx, fip.path)
+		} else {
+			currentListing.hasCapability =
+				hasCapabilityContext(ctx, dirname+"/"+fip.path)
+		}
 	}
 
+	// character, block, pipe or socket?
+	setFileType(&currentListing, fip.info.Mode())
+
 	return currentListing, nil
 }
 
@@ -543,7 +1574,8 @@ func sortListingsDirsFirst(listings []Listing) []Listing {
 	return listingsSorted
 }
 
-// Comparison function used for sorting Listings by name.
+// Comparison function used for sorting Listings by name, ignoring case unless
+// the names differ only in case.  Returns 0 only for the same name.
 func compareName(a, b Listing) int {
 	aNameLower := strings.ToLower(a.name)
 	bNameLower := strings.ToLower(b.name)
@@ -568,49 +1600,72 @@ func compareName(a, b Listing) int {
 	} else if len(b.name) < len(a.name) {
 		return 1
 	} else {
-		return 0
+		return strings.Compare(a.name, b.name)
 	}
 }
 
 // Comparison function used for sorting Listings by modification time, from most
-// recent to oldest.
+// recent to oldest, and by name for the same time.
 func compareTime(a, b Listing) int {
-	if a.epochNano >= b.epochNano {
+	if a.epochNano > b.epochNano {
 		return -1
+	} else if a.epochNano < b.epochNano {
+		return 1
 	}
 
-	return 1
+	return compareName(a, b)
 }
 
 // Comparison function used for sorting Listings by size, from largest to
-// smallest.
+// smallest, and by name for the same size.
 func compareSize(a, b Listing) int {
-	a_size, _ := strconv.Atoi(a.size)
-	b_size, _ := strconv.Atoi(b.size)
+	if a.sizeBytes > b.sizeBytes {
+		return -1
+	} else if a.sizeBytes < b.sizeBytes {
+		return 1
+	}
+
+	return compareName(a, b)
+}
 
-	if a_size >= b_size {
+// Comparison function used for sorting Listings by the number of entries in
+// directories, from most to fewest, and by name for the same number.  Other
+// files come after all directories.
+func compareCount(a, b Listing) int {
+	if a.countEntries > b.countEntries {
 		return -1
+	} else if a.countEntries < b.countEntries {
+		return 1
 	}
 
-	return 1
+	return compareName(a, b)
 }
 
-// Sort the given listings, taking into account the current program options.
-func sortListings(listings []Listing) {
-	comparisonFunction := compareName
+// Return the comparison function for the sort key of the current program
+// options (-t, -S or --sort), or compareName if there is none.
+func getComparisonFunction() func(a, b Listing) int {
 	if options.sortTime {
-		comparisonFunction = compareTime
+		return compareTime
 	} else if options.sortSize {
-		comparisonFunction = compareSize
+		return compareSize
+	} else if options.sortCount {
+		return compareCount
 	}
 
+	return compareName
+}
+
+// Sort the given listings, taking into account the current program options.
+func sortListings(listings []Listing) {
+	comparisonFunction := getComparisonFunction()
+
 	for {
 		done := true
 		for i := 0; i < len(listings)-1; i++ {
 			a := listings[i]
 			b := listings[i+1]
 
-			if comparisonFunction(a, b) > -1 {
+			if comparisonFunction(a, b) > 0 {
 				tmp := a
 				listings[i] = listings[i+1]
 				listings[i+1] = tmp
@@ -643,66 +1698,210 @@ func sortListings(listings []Listing) {
 	}
 }
 
+// Report whether a directory entry is listed: .dotfiles only are with -a.
+func isListedName(name string) bool {
+	return options.all || !strings.HasPrefix(name, ".")
+}
+
 // Create a set of Listings, comprised of the files and directories currently in
-// the given directory.
-func listFilesInDir(dir Listing) ([]Listing, error) {
+// the given directory.  Entries that do not answer within --timeout are listed
+// as placeholders, and so is a directory that cannot be read in time: its
+// entries are replaced with a single "?" one.
+func listFilesInDir(ctx context.Context, dir Listing) ([]Listing, error) {
 	l := make([]Listing, 0)
 
 	if options.all {
 		//info_dot, err := os.Stat(dir.path)
-		infoDot, err := os.Stat(dir.name)
-		if err != nil {
+		infoDot, err := statContext(ctx, dir.name)
+		listingDot := createTimedOutListing(".")
+		if err != nil && err != errTimedOut {
 			return l, err
+		} else if err == nil {
+			listingDot, err = createListing(ctx, dir.name,
+				FileInfoPath{".", infoDot})
+			if err != nil {
+				return l, err
+			}
 		}
 
-		listingDot, err := createListing(dir.name,
-			FileInfoPath{".", infoDot})
-		if err != nil {
+		infoDotdot, err := statContext(ctx, dir.name+"/..")
+		listingDotdot := createTimedOutListing("..")
+		if err != nil && err != errTimedOut {
 			return l, err
+		} else if err == nil {
+			listingDotdot, err = createListing(ctx, dir.name,
+				FileInfoPath{"..", infoDotdot})
+			if err != nil {
+				return l, err
+			}
 		}
 
-		infoDotdot, err := os.Stat(dir.name + "/..")
-		if err != nil {
-			return l, err
-		}
+		l = append(l, listingDot)
+		l = append(l, listingDotdot)
+	}
 
-		listingDotdot, err := createListing(dir.name,
-			FileInfoPath{"..", infoDotdot})
+	var namesInDir []string
+	err := callWithTimeout(ctx, func() error {
+		dirFile, err := os.Open(dir.name)
 		if err != nil {
-			return l, err
+			return err
 		}
+		defer dirFile.Close()
+
+		namesInDir, err = dirFile.Readdirnames(-1)
+		return err
+	})
+	if err == errTimedOut {
+		return append(l, createTimedOutListing("?")), nil
+	} else if err != nil {
+		return l, err
+	}
+	sort.Strings(namesInDir)
 
-		l = append(l, listingDot)
-		l = append(l, listingDotdot)
+	names := make([]string, 0, len(namesInDir))
+	for _, name := range namesInDir {
+		if isListedName(name) {
+			names = append(names, name)
+		}
 	}
 
-	filesInDir, err := ioutil.ReadDir(dir.name)
+	_l, err := createListings(ctx, dir.name, names)
 	if err != nil {
 		return l, err
 	}
+	l = append(l, _l...)
 
-	for _, f := range filesInDir {
-		// if this is a .dotfile and '-a' is not specified, skip it
-		if []rune(f.Name())[0] == rune('.') && !options.all {
-			continue
+	if options.dirSize {
+		setDirSizes(ctx, dir.name, l)
+	}
+	sortListings(l)
+
+	return l, nil
+}
+
+// Stat the given entries of a directory and convert them to Listings, using a
+// pool of options.jobs workers that share statSlots with the workers of the
+// other directories being read.  The Listings are returned in the same order as
+// the names, and if several entries fail, the error of the first one is
+// returned, just as a serial loop would.  Entries that time out are returned as
+// placeholders, and cancelling ctx stops the workers early.
+func createListings(ctx context.Context, dirname string,
+	names []string) ([]Listing, error) {
+	listings := make([]Listing, len(names))
+	errs := make([]error, len(names))
+
+	numWorkers := options.jobs
+	if numWorkers < 1 {
+		numWorkers = 1
+	} else if numWorkers > len(names) {
+		numWorkers = len(names)
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				select {
+				case statSlots <- struct{}{}:
+				case <-ctx.Done():
+					continue
+				}
+				info, err := statListing(ctx, dirname+"/"+names[i],
+					options.dereference)
+				if err == nil {
+					listings[i], err = createListing(ctx, dirname,
+						FileInfoPath{names[i], info})
+				}
+				if err == errTimedOut {
+					listings[i] = createTimedOutListing(names[i])
+					err = nil
+				}
+				<-statSlots
+				errs[i] = err
+			}
+		}()
+	}
+
+feed:
+	for i := range names {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
 		}
+	}
+	close(indexes)
+	wg.Wait()
 
-		_l, err := createListing(dir.name,
-			FileInfoPath{f.Name(), f})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, err := range errs {
 		if err != nil {
-			return l, err
+			return nil, err
 		}
-		l = append(l, _l)
 	}
 
-	sortListings(l)
+	return listings, nil
+}
 
-	return l, nil
+// Return the widths of the inode (-i) and allocated size (-s) columns for the
+// given listings, or 0 for the columns that aren't shown.
+func getPrefixWidths(listings []Listing) (int, int) {
+	widthInode := 0
+	widthBlocks := 0
+	for _, l := range listings {
+		if options.inode && displayWidth(l.inode) > widthInode {
+			widthInode = displayWidth(l.inode)
+		}
+		if options.blocks && displayWidth(l.blocks) > widthBlocks {
+			widthBlocks = displayWidth(l.blocks)
+		}
+	}
+
+	return widthInode, widthBlocks
+}
+
+// Return the inode number (-i) and allocated size (-s) of a listing, right
+// justified to the given widths and followed by a space each, as they are
+// written in front of the rest of the listing.
+func getListingPrefix(l Listing, widthInode int, widthBlocks int) string {
+	prefix := ""
+	if options.inode {
+		for i := 0; i < widthInode-displayWidth(l.inode); i++ {
+			prefix += " "
+		}
+		prefix += l.inode + " "
+	}
+	if options.blocks {
+		for i := 0; i < widthBlocks-displayWidth(l.blocks); i++ {
+			prefix += " "
+		}
+		prefix += l.blocks + " "
+	}
+
+	return prefix
+}
+
+// Write the "total N" line in front of the contents of a directory, with the
+// allocated size of all the listings, like GNU ls does for -l and -s.
+func writeTotal(output *outputWriter, listings []Listing) {
+	var total int64
+	for _, l := range listings {
+		total += l.blocksBytes
+	}
+
+	output.WriteString("total " + formatBlocks(total))
+	output.deferString("\n")
 }
 
-// Given a set of Listings, print them to the output buffer, taking into account
-// the current program arguments and terminal width as necessary.
-func writeListingsToBuffer(output_buffer *bytes.Buffer,
+// Given a set of Listings, print them to the output, taking into account
+// the current program arguments and terminal width as necessary.  All widths
+// are measured in terminal cells, so wide and combining characters line up.
+func writeListingsToBuffer(output *outputWriter,
 	listings []Listing,
 	terminalWidth int) {
 
@@ -710,6 +1909,8 @@ func writeListingsToBuffer(output_buffer *bytes.Buffer,
 		return
 	}
 
+	widthInode, widthBlocks := getPrefixWidths(listings)
+
 	if options.long {
 		var (
 			widthPermissions  = 0
@@ -717,180 +1918,438 @@ func writeListingsToBuffer(output_buffer *bytes.Buffer,
 			widthOwner        = 0
 			widthGroup        = 0
 			widthSize         = 0
+			widthCount        = 0
+			widthMonth        = 0
+			widthDay          = 0
 			widthTime         = 0
 		)
 		// check max widths for each field
 		for _, l := range listings {
-			if len(l.permissions) > widthPermissions {
-				widthPermissions = len(l.permissions)
+			if displayWidth(l.permissions) > widthPermissions {
+				widthPermissions = displayWidth(l.permissions)
+			}
+			if displayWidth(l.numHardLinks) > widthNumHardLinks {
+				widthNumHardLinks = displayWidth(l.numHardLinks)
+			}
+			if !options.noOwner && displayWidth(l.owner) > widthOwner {
+				widthOwner = displayWidth(l.owner)
 			}
-			if len(l.numHardLinks) > widthNumHardLinks {
-				widthNumHardLinks = len(l.numHardLinks)
+			if !options.noGroup && displayWidth(l.group) > widthGroup {
+				widthGroup = displayWidth(l.group)
 			}
-			if len(l.owner) > widthOwner {
-				widthOwner = len(l.owner)
+			if displayWidth(l.size) > widthSize {
+				widthSize = displayWidth(l.size)
 			}
-			if len(l.group) > widthGroup {
-				widthGroup = len(l.group)
+			if displayWidth(l.count) > widthCount {
+				widthCount = displayWidth(l.count)
 			}
-			if len(l.size) > widthSize {
-				widthSize = len(l.size)
+			if displayWidth(l.month) > widthMonth {
+				widthMonth = displayWidth(l.month)
 			}
-			if len(l.time) > widthTime {
-				widthTime = len(l.time)
+			if displayWidth(l.day) > widthDay {
+				widthDay = displayWidth(l.day)
+			}
+			if displayWidth(l.time) > widthTime {
+				widthTime = displayWidth(l.time)
 			}
 		}
 
+		// colors for the columns, if --color-columns is in effect
+		colorPerms := options.color && options.colorColumns["perms"]
+		colorSize := options.color && options.colorColumns["size"]
+		colorAge := options.color && options.colorColumns["age"]
+		colorOwner := options.color && options.colorColumns["owner"]
+
 		// now print the listings
 		for _, l := range listings {
+			// inode and allocated size
+			output.WriteString(getListingPrefix(l, widthInode, widthBlocks))
+
 			// permissions
-			output_buffer.WriteString(l.permissions)
-			for i := 0; i < widthPermissions-len(l.permissions); i++ {
-				output_buffer.WriteString(" ")
+			if colorPerms {
+				writePermissions(output, l.permissions)
+			} else {
+				output.WriteString(l.permissions)
+			}
+			for i := 0; i < widthPermissions-displayWidth(l.permissions); i++ {
+				output.WriteString(" ")
 			}
-			output_buffer.WriteString(" ")
+			output.WriteString(" ")
 
 			// number of hard links (right justified)
-			for i := 0; i < widthNumHardLinks-len(l.numHardLinks); i++ {
-				output_buffer.WriteString(" ")
+			padding := widthNumHardLinks - displayWidth(l.numHardLinks)
+			for i := 0; i < padding; i++ {
+				output.WriteString(" ")
 			}
 			for i := 0; i < 2-widthNumHardLinks; i++ {
-				output_buffer.WriteString(" ")
+				output.WriteString(" ")
+			}
+			output.WriteString(l.numHardLinks)
+			output.WriteString(" ")
+
+			// owner (unless -g)
+			if options.noOwner {
+				// no owner column
+			} else if colorOwner && l.owner == currentUserName {
+				writeColored(output, l.owner, colorMap["column_owner_self"])
+			} else {
+				output.WriteString(l.owner)
+			}
+			if !options.noOwner {
+				for i := 0; i < widthOwner-displayWidth(l.owner); i++ {
+					output.WriteString(" ")
+				}
+				output.WriteString(" ")
+			}
+
+			// group (unless -o or -G)
+			if options.noGroup {
+				// no group column
+			} else if colorOwner && currentUserGroups[l.group] {
+				writeColored(output, l.group, colorMap["column_group_self"])
+			} else {
+				output.WriteString(l.group)
+			}
+			if !options.noGroup {
+				for i := 0; i < widthGroup-displayWidth(l.group); i++ {
+					output.WriteString(" ")
+				}
+				output.WriteString(" ")
 			}
-			output_buffer.WriteString(l.numHardLinks)
-			output_buffer.WriteString(" ")
 
-			// owner
-			output_buffer.WriteString(l.owner)
-			for i := 0; i < widthOwner-len(l.owner); i++ {
-				output_buffer.WriteString(" ")
+			// size
+			for i := 0; i < widthSize-displayWidth(l.size); i++ {
+				output.WriteString(" ")
+			}
+			if colorSize {
+				writeColored(output, l.size, getSizeColor(l))
+			} else {
+				output.WriteString(l.size)
 			}
-			output_buffer.WriteString(" ")
+			output.WriteString(" ")
 
-			// group
-			output_buffer.WriteString(l.group)
-			for i := 0; i < widthGroup-len(l.group); i++ {
-				output_buffer.WriteString(" ")
+			// number of entries (--count)
+			if options.count {
+				for i := 0; i < widthCount-displayWidth(l.count); i++ {
+					output.WriteString(" ")
+				}
+				output.WriteString(l.count)
+				output.WriteString(" ")
 			}
-			output_buffer.WriteString(" ")
 
-			// size
-			for i := 0; i < widthSize-len(l.size); i++ {
-				output_buffer.WriteString(" ")
+			ageColor := ""
+			if colorAge {
+				ageColor = getAgeColor(l)
 			}
-			output_buffer.WriteString(l.size)
-			output_buffer.WriteString(" ")
 
-			// month
-			output_buffer.WriteString(l.month)
-			output_buffer.WriteString(" ")
+			// month and day, unless the --time-style puts the whole time
+			// in a single column
+			if isDefaultTimeStyle() {
+				for i := 0; i < widthMonth-displayWidth(l.month); i++ {
+					output.WriteString(" ")
+				}
+				writeColored(output, l.month, ageColor)
+				output.WriteString(" ")
 
-			// day
-			output_buffer.WriteString(l.day)
-			output_buffer.WriteString(" ")
+				for i := 0; i < widthDay-displayWidth(l.day); i++ {
+					output.WriteString(" ")
+				}
+				writeColored(output, l.day, ageColor)
+				output.WriteString(" ")
+			}
 
 			// time
-			for i := 0; i < widthTime-len(l.time); i++ {
-				output_buffer.WriteString(" ")
+			for i := 0; i < widthTime-displayWidth(l.time); i++ {
+				output.WriteString(" ")
 			}
-			output_buffer.WriteString(l.time)
-			output_buffer.WriteString(" ")
+			writeColored(output, l.time, ageColor)
+			output.WriteString(" ")
 
 			// name
-			writeListingName(output_buffer, l)
-			output_buffer.WriteString("\n")
-		}
-		if output_buffer.Len() > 0 {
-			output_buffer.Truncate(output_buffer.Len() - 1)
+			writeListingName(output, l)
+			output.WriteString(getIndicator(l))
+			output.deferString("\n")
 		}
+		output.trimPending(1)
 	} else if options.one {
 		separator := "\n"
 
 		for _, l := range listings {
-			writeListingName(output_buffer, l)
-			output_buffer.WriteString(separator)
+			output.WriteString(getListingPrefix(l, widthInode, widthBlocks))
+			writeListingName(output, l)
+			output.WriteString(getIndicator(l))
+			output.deferString(separator)
 		}
-		if output_buffer.Len() > 0 {
-			output_buffer.Truncate(output_buffer.Len() - 1)
+		output.trimPending(len(separator))
+	} else if options.commas {
+		// fill each line with as many names as fit, like GNU ls -m
+		position := 0
+		for i, l := range listings {
+			prefix := getListingPrefix(l, 0, 0)
+			nameWidth := displayWidth(prefix) +
+				displayWidth(quoteName(l.name)) + len(getIndicator(l))
+			if i > 0 && position+nameWidth+2 < terminalWidth {
+				output.WriteString(", ")
+				position += 2
+			} else if i > 0 {
+				output.WriteString(",\n")
+				position = 0
+			}
+
+			output.WriteString(prefix)
+			writeListingName(output, l)
+			output.WriteString(getIndicator(l))
+			position += nameWidth
 		}
 	} else {
 		separator := "  "
 
-		// calculate the number of rows needed for column output
-		numRows := 1
-		var colWidths []int
-		for {
-			numColsFloat := float64(len(listings)) / float64(numRows)
-			numColsFloat = math.Ceil(numColsFloat)
-			numCols := int(numColsFloat)
-
-			colWidths = make([]int, numCols)
-			for i := range colWidths {
-				colWidths[i] = 0
-			}
+		// the width of every name as it will be displayed, with indicator
+		// and the -i and -s columns
+		nameWidths := make([]int, len(listings))
+		prefixes := make([]string, len(listings))
+		for i, l := range listings {
+			prefixes[i] = getListingPrefix(l, widthInode, widthBlocks)
+			nameWidths[i] = displayWidth(prefixes[i]) +
+				displayWidth(quoteName(l.name)) + len(getIndicator(l))
+		}
 
-			colListings := make([]int, numCols)
-			for i := 0; i < len(colListings); i++ {
-				colListings[i] = 0
-			}
+		numRows, colWidths := calculateColumns(nameWidths, len(separator),
+			terminalWidth, options.across)
 
-			// calculate necessary column widths
-			// also calculate the number of listings per column
-			for i := 0; i < len(listings); i++ {
-				col := i / numRows
-				if colWidths[col] < len(listings[i].name) {
-					colWidths[col] = len(listings[i].name)
+		if options.across {
+			// with -x, the names fill the rows first
+			numCols := len(colWidths)
+			for i, l := range listings {
+				if i > 0 && i%numCols == 0 {
+					output.trimPending(len(separator))
+					output.deferString("\n")
 				}
-				colListings[col]++
-			}
-
-			// calculate the maximum width of each row
-			maxRowLength := 0
-			for i := 0; i < numCols; i++ {
-				maxRowLength += colWidths[i]
-			}
-			maxRowLength += len(separator) * (numCols - 1)
-
-			if maxRowLength > terminalWidth && numRows >= len(listings) {
-				break
-			} else if maxRowLength > terminalWidth {
-				numRows++
-			} else {
-				listingsInFirstCol := colListings[0]
-				listingsInLastCol := colListings[len(colListings)-1]
-
-				// prevent short last (right-hand) columns
-				if listingsInLastCol <= listingsInFirstCol/2 &&
-					listingsInFirstCol-listingsInLastCol >= 5 {
-					numRows++
-				} else {
-					break
+				output.WriteString(prefixes[i])
+				writeListingName(output, l)
+				output.WriteString(getIndicator(l))
+				for s := 0; s < colWidths[i%numCols]-nameWidths[i]; s++ {
+					output.WriteString(" ")
 				}
+				output.deferString(separator)
 			}
+			output.trimPending(len(separator))
+			return
 		}
 
 		for r := 0; r < numRows; r++ {
 			for i, l := range listings {
 				if i%numRows == r {
-					writeListingName(output_buffer, l)
-					for s := 0; s < colWidths[i/numRows]-len(l.name); s++ {
-						output_buffer.WriteString(" ")
+					output.WriteString(prefixes[i])
+					writeListingName(output, l)
+					output.WriteString(getIndicator(l))
+					for s := 0; s < colWidths[i/numRows]-nameWidths[i]; s++ {
+						output.WriteString(" ")
 					}
-					output_buffer.WriteString(separator)
+					output.deferString(separator)
 				}
 			}
-			if len(listings) > 0 {
-				output_buffer.Truncate(output_buffer.Len() - len(separator))
+			output.trimPending(len(separator))
+			output.deferString("\n")
+		}
+		output.trimPending(1)
+	}
+}
+
+// Given the display widths of a set of names, calculate the number of rows
+// needed to list them in columns that fit in the terminal width, and the width
+// of each column.  The names fill the columns first, or the rows first if
+// across is set (-x).
+func calculateColumns(nameWidths []int, separatorWidth int,
+	terminalWidth int, across bool) (int, []int) {
+
+	numRows := 1
+	var colWidths []int
+	for {
+		numColsFloat := float64(len(nameWidths)) / float64(numRows)
+		numColsFloat = math.Ceil(numColsFloat)
+		numCols := int(numColsFloat)
+
+		colWidths = make([]int, numCols)
+		for i := range colWidths {
+			colWidths[i] = 0
+		}
+
+		colListings := make([]int, numCols)
+		for i := 0; i < len(colListings); i++ {
+			colListings[i] = 0
+		}
+
+		// calculate necessary column widths
+		// also calculate the number of listings per column
+		for i := 0; i < len(nameWidths); i++ {
+			col := i / numRows
+			if across {
+				col = i % numCols
+			}
+			if colWidths[col] < nameWidths[i] {
+				colWidths[col] = nameWidths[i]
+			}
+			colListings[col]++
+		}
+
+		// calculate the maximum width of each row
+		maxRowLength := 0
+		for i := 0; i < numCols; i++ {
+			maxRowLength += colWidths[i]
+		}
+		maxRowLength += separatorWidth * (numCols - 1)
+
+		if maxRowLength > terminalWidth && numRows >= len(nameWidths) {
+			break
+		} else if maxRowLength > terminalWidth {
+			numRows++
+		} else if across {
+			// a short last row is fine when filling the rows first
+			break
+		} else {
+			listingsInFirstCol := colListings[0]
+			listingsInLastCol := colListings[len(colListings)-1]
+
+			// prevent short last (right-hand) columns
+			if listingsInLastCol <= listingsInFirstCol/2 &&
+				listingsInFirstCol-listingsInLastCol >= 5 {
+				numRows++
+			} else {
+				break
 			}
-			output_buffer.WriteString("\n")
 		}
-		output_buffer.Truncate(output_buffer.Len() - 1)
 	}
+
+	return numRows, colWidths
+}
+
+// Print a warning about something that doesn't stop the listing, like an
+// unreadable subdirectory.  The output is flushed first, so the warning shows
+// up on its own line after what has been listed so far.
+func warn(output *outputWriter, format string, a ...interface{}) {
+	output.endLine()
+	output.Flush()
+	fmt.Fprintf(os.Stderr, "ls: "+format+"\n", a...)
+}
+
+// Report whether -R should skip a directory because of --prune.
+func isPruned(name string) bool {
+	for _, pattern := range options.prune {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the subdirectories that -R descends into from the given directory,
+// in the order they were listed in, honoring --max-depth, --prune and
+// --one-file-system.
+func getSubdirsToList(dir queuedDir, listings []Listing) []queuedDir {
+	subdirs := make([]queuedDir, 0)
+	if !options.recursive ||
+		(options.maxDepth >= 0 && dir.depth >= options.maxDepth) {
+		return subdirs
+	}
+
+	for _, l := range listings {
+		if l.permissions[0] != 'd' || l.name == "." || l.name == ".." {
+			continue
+		} else if isPruned(l.name) {
+			continue
+		} else if options.oneFileSystem && l.dev != dir.rootDev {
+			continue
+		}
+
+		subdir := l
+		subdir.name = strings.TrimSuffix(dir.listing.name, "/") + "/" + l.name
+		subdirs = append(subdirs,
+			queuedDir{subdir, dir.depth + 1, dir.rootDev, nil})
+	}
+
+	return subdirs
+}
+
+// Parse the value of --timeout, either a Go duration like "1.5s" or a plain
+// number of seconds.
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, _err := strconv.ParseFloat(value, 64)
+		if _err != nil {
+			return 0, fmt.Errorf("invalid timeout: %s", value)
+		}
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout: %s", value)
+	}
+
+	return timeout, nil
+}
+
+// Parse the value of --block-size: a number of bytes, a unit or a number
+// followed by a unit.  The units K, M, G, T, P and E (or KiB, MiB...) are
+// powers of 1024, KB, MB... powers of 1000.  When the value is just a unit, it
+// is also returned as the suffix to write after every size, like GNU ls does.
+func parseBlockSize(value string) (int64, string, error) {
+	units := "KMGTPE"
+
+	number := value
+	unit := ""
+	for i, c := range value {
+		if c < '0' || c > '9' {
+			number = value[:i]
+			unit = value[i:]
+			break
+		}
+	}
+
+	multiplier := int64(1)
+	if unit != "" {
+		letter := strings.ToUpper(unit[0:1])
+		if !strings.Contains(units, letter) || (unit[1:] != "" &&
+			unit[1:] != "B" && unit[1:] != "iB") {
+			return 0, "", fmt.Errorf("invalid block size: %s", value)
+		}
+
+		base := int64(1024)
+		if unit[1:] == "B" {
+			base = 1000
+		}
+		for i := 0; i <= strings.Index(units, letter); i++ {
+			multiplier *= base
+		}
+	}
+
+	blockSize := int64(1)
+	suffix := ""
+	if number != "" {
+		var err error
+		blockSize, err = strconv.ParseInt(number, 10, 64)
+		if err != nil || blockSize < 1 {
+			return 0, "", fmt.Errorf("invalid block size: %s", value)
+		}
+	} else if unit == "KB" {
+		// SI kilo is a lowercase k
+		suffix = "kB"
+	} else if unit != "" {
+		suffix = unit
+	} else {
+		return 0, "", fmt.Errorf("invalid block size: %s", value)
+	}
+
+	return blockSize * multiplier, suffix, nil
 }
 
-// Parse the program arguments and write the appropriate listings to the output
-// buffer.
-func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
+// Parse the program arguments and write the appropriate listings to the output.
+// The output is flushed after every directory, so the caller sees results as
+// they are produced.  Cancelling ctx stops the listing at the next filesystem
+// call and returns ctx.Err().
+func ls(ctx context.Context, output *outputWriter, args []string,
+	width int, height int) error {
 	argsOptions := make([]string, 0)
 	argsFiles := make([]string, 0)
 	listDirs := make([]Listing, 0)
@@ -977,19 +2436,237 @@ func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
 	//
 	options = Options{}
 	options.color = true // use color by default
+	options.jobs = runtime.NumCPU()
+	options.maxDepth = -1
+	options.colorColumns = make(map[string]bool)
+
+	// like GNU ls, quote names for the shell (and hide control characters,
+	// whatever QUOTING_STYLE says) when writing to a terminal, and write them
+	// as they are otherwise
+	options.quotingStyle = "literal"
+	options.hideControl = output.isTerminal
+	if os.Getenv("QUOTING_STYLE") != "" {
+		for _, name := range quotingStyles {
+			if os.Getenv("QUOTING_STYLE") == name {
+				options.quotingStyle = name
+			}
+		}
+	} else if output.isTerminal {
+		options.quotingStyle = "shell-escape"
+	}
+	if os.Getenv("TIME_STYLE") != "" {
+		style, err := parseTimeStyle(os.Getenv("TIME_STYLE"))
+		if err == nil {
+			options.timeStyle = style
+		}
+	}
 	for _, o := range argsOptions {
 
 		// is it a short option '-' or a long option '--'?
 		if strings.Contains(o, "--") {
+			if o == "--count" {
+				options.count = true
+			}
+			if o == "--dir-size" {
+				options.dirSize = true
+			}
 			if strings.Contains(o, "--dirs-first") {
 				options.dirsFirst = true
 			}
 			if strings.Contains(o, "--help") {
 				options.help = true
 			}
+			if strings.HasPrefix(o, "--jobs=") {
+				jobs, err := strconv.Atoi(strings.TrimPrefix(o, "--jobs="))
+				if err != nil || jobs < 1 {
+					return fmt.Errorf("invalid number of jobs: %s",
+						strings.TrimPrefix(o, "--jobs="))
+				}
+				options.jobs = jobs
+			}
+			if strings.HasPrefix(o, "--timeout=") {
+				timeout, err := parseTimeout(
+					strings.TrimPrefix(o, "--timeout="))
+				if err != nil {
+					return err
+				}
+				options.timeout = timeout
+			}
+			if strings.HasPrefix(o, "--max-depth=") {
+				depth, err := strconv.Atoi(
+					strings.TrimPrefix(o, "--max-depth="))
+				if err != nil || depth < 0 {
+					return fmt.Errorf("invalid maximum depth: %s",
+						strings.TrimPrefix(o, "--max-depth="))
+				}
+				options.recursive = true
+				options.maxDepth = depth
+			}
+			if o == "--stats" {
+				options.stats = "text"
+			}
+			if strings.HasPrefix(o, "--stats=") {
+				format := strings.TrimPrefix(o, "--stats=")
+				if format != "text" && format != "json" {
+					return fmt.Errorf("invalid stats format: %s", format)
+				}
+				options.stats = format
+			}
+			if strings.HasPrefix(o, "--histogram=") {
+				by := strings.TrimPrefix(o, "--histogram=")
+				if by != "size" && by != "mtime" {
+					return fmt.Errorf("invalid histogram: %s", by)
+				}
+				options.histogram = by
+			}
+			if o == "--treemap" {
+				options.treemap = true
+				options.dirSize = true
+			}
+			if strings.HasPrefix(o, "--top=") {
+				top, err := strconv.Atoi(strings.TrimPrefix(o, "--top="))
+				if err != nil || top < 1 {
+					return fmt.Errorf("invalid number of files: %s",
+						strings.TrimPrefix(o, "--top="))
+				}
+				options.recursive = true
+				options.long = true
+				options.top = top
+			}
+			if o == "--one-file-system" {
+				options.oneFileSystem = true
+			}
+			if strings.HasPrefix(o, "--prune=") {
+				pattern := strings.TrimPrefix(o, "--prune=")
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid pattern: %s", pattern)
+				}
+				options.prune = append(options.prune, pattern)
+			}
 			if strings.Contains(o, "--nocolor") {
 				options.color = false
 			}
+			if strings.Contains(o, "--print-colors") {
+				options.printColors = true
+			}
+			if strings.HasPrefix(o, "--block-size=") {
+				value := strings.TrimPrefix(o, "--block-size=")
+				if strings.HasPrefix(value, "'") {
+					options.groupDigits = true
+					value = value[1:]
+				}
+
+				if value == "human-readable" {
+					options.human = true
+				} else if value == "si" {
+					options.human = true
+					options.si = true
+				} else {
+					blockSize, suffix, err := parseBlockSize(value)
+					if err != nil {
+						return err
+					}
+					options.blockSize = blockSize
+					options.blockSuffix = suffix
+				}
+			}
+			if o == "--full-time" {
+				options.long = true
+				options.timeStyle = "full-iso"
+			}
+			if strings.HasPrefix(o, "--time-style=") {
+				style, err := parseTimeStyle(
+					strings.TrimPrefix(o, "--time-style="))
+				if err != nil {
+					return err
+				}
+				options.timeStyle = style
+			}
+			if strings.HasPrefix(o, "--tz=") {
+				location, err := time.LoadLocation(
+					strings.TrimPrefix(o, "--tz="))
+				if err != nil {
+					return fmt.Errorf("invalid time zone: %s",
+						strings.TrimPrefix(o, "--tz="))
+				}
+				options.location = location
+			}
+			if o == "--iec" {
+				options.human = true
+				options.iec = true
+			}
+			if o == "--si" {
+				options.human = true
+				options.si = true
+			}
+			if strings.HasPrefix(o, "--dircolors=") {
+				options.dircolors = strings.TrimPrefix(o, "--dircolors=")
+			}
+			if strings.HasPrefix(o, "--quoting-style=") {
+				style := strings.TrimPrefix(o, "--quoting-style=")
+				known := false
+				for _, name := range quotingStyles {
+					if style == name {
+						known = true
+					}
+				}
+				if !known {
+					return fmt.Errorf("invalid quoting style: %s", style)
+				}
+				options.quotingStyle = style
+			}
+			if strings.HasPrefix(o, "--indicator-style=") {
+				style := strings.TrimPrefix(o, "--indicator-style=")
+				if style != "none" && style != "slash" &&
+					style != "file-type" && style != "classify" {
+					return fmt.Errorf("invalid indicator style: %s", style)
+				}
+				options.indicatorStyle = style
+			}
+			if o == "--classify" {
+				options.indicatorStyle = "classify"
+			}
+			if o == "--file-type" {
+				options.indicatorStyle = "file-type"
+			}
+			if o == "--link-chain" {
+				options.linkChain = true
+			}
+			if o == "--literal" {
+				options.quotingStyle = "literal"
+			}
+			if strings.HasPrefix(o, "--sort=") {
+				key := strings.TrimPrefix(o, "--sort=")
+				if key != "name" && key != "size" && key != "time" &&
+					key != "count" {
+					return fmt.Errorf("invalid sort key: %s", key)
+				}
+				options.sortSize = key == "size"
+				options.sortTime = key == "time"
+				options.sortCount = key == "count"
+			}
+			if strings.HasPrefix(o, "--theme=") {
+				options.theme = strings.TrimPrefix(o, "--theme=")
+			}
+			if o == "--color-columns" {
+				for _, column := range colorColumnNames {
+					options.colorColumns[column] = true
+				}
+			} else if strings.HasPrefix(o, "--color-columns=") {
+				columns := strings.TrimPrefix(o, "--color-columns=")
+				for _, column := range strings.Split(columns, ",") {
+					known := false
+					for _, name := range colorColumnNames {
+						if column == name {
+							known = true
+						}
+					}
+					if !known {
+						return fmt.Errorf("invalid column to color: %s", column)
+					}
+					options.colorColumns[column] = true
+				}
+			}
 		} else {
 			if strings.Contains(o, "1") {
 				options.one = true
@@ -1003,117 +2680,238 @@ func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
 			if strings.Contains(o, "h") {
 				options.human = true
 			}
+			if strings.Contains(o, "H") {
+				options.dereferenceArgs = true
+			}
+			if strings.Contains(o, "i") {
+				options.inode = true
+			}
 			if strings.Contains(o, "l") {
 				options.long = true
 			}
+			if strings.Contains(o, "L") {
+				options.dereference = true
+			}
 			if strings.Contains(o, "r") {
 				options.sortReverse = true
 			}
+			if strings.Contains(o, "R") {
+				options.recursive = true
+			}
 			if strings.Contains(o, "t") {
 				options.sortTime = true
 			}
+			if strings.Contains(o, "s") {
+				options.blocks = true
+			}
 			if strings.Contains(o, "S") {
 				options.sortSize = true
 			}
+			if strings.Contains(o, "b") {
+				options.quotingStyle = "escape"
+			}
+			if strings.Contains(o, "C") {
+				options.columns = true
+			}
+			if strings.Contains(o, "F") {
+				options.indicatorStyle = "classify"
+			}
+			if strings.Contains(o, "g") {
+				options.long = true
+				options.noOwner = true
+			}
+			if strings.Contains(o, "G") {
+				options.noGroup = true
+			}
+			if strings.Contains(o, "m") {
+				options.commas = true
+			}
+			if strings.Contains(o, "n") {
+				options.long = true
+				options.numericIDs = true
+			}
+			if strings.Contains(o, "o") {
+				options.long = true
+				options.noGroup = true
+			}
+			if strings.Contains(o, "p") {
+				options.indicatorStyle = "slash"
+			}
+			if strings.Contains(o, "N") {
+				options.quotingStyle = "literal"
+			}
+			if strings.Contains(o, "q") {
+				options.hideControl = true
+			}
+			if strings.Contains(o, "Q") {
+				options.quotingStyle = "c"
+			}
+			if strings.Contains(o, "x") {
+				options.across = true
+			}
 		}
 	}
 
+	options.monthNames = getLocaleMonthNames()
+
+	// like GNU ls, list one name per line unless writing to a terminal or
+	// asked for another layout
+	if !output.isTerminal && !options.columns && !options.across &&
+		!options.commas {
+		options.one = true
+	}
+
 	if options.help {
 		helpStr := "usage:  ls [OPTIONS] [FILES]\n\n" +
 			"OPTIONS:\n" +
-			"    --dirs-first  list directories first\n" +
-			"    --help        display usage information\n" +
-			"    --nocolor     remove color formatting\n" +
-			"    -1            one entry per line\n" +
-			"    -a            include entries starting with '.'\n" +
-			"    -d            list directories like files\n" +
-			"    -h            list sizes with human-readable units\n" +
-			"    -l            long listing\n" +
-			"    -r            reverse any sorting\n" +
-			"    -t            sort entries by modify time\n" +
-			"    -S            sort entries by size"
-		outputBuffer.WriteString(helpStr)
-		return nil
+			"  --block-size=SIZE     scale sizes by SIZE (e.g. 512, K,\n" +
+			"                        4MB); a leading ' groups digits in\n" +
+			"                        thousands\n" +
+			"  --classify            append an indicator to names (-F)\n" +
+			"  --color-columns[=LIST]\n" +
+			"                        color long format columns (any of\n" +
+			"                        perms,size,age,owner; default all)\n" +
+			"  --count               count the entries of directories\n" +
+			"  --dir-size            add up the size of directory contents\n" +
+			"  --dircolors=FILE      take colors from a dircolors database\n" +
+			"  --dirs-first          list directories first\n" +
+			"  --file-type           like --classify, but without '*'\n" +
+			"  --full-time           like -l --time-style=full-iso\n" +
+			"  --help                display usage information\n" +
+			"  --histogram=WORD      chart how many files there are by\n" +
+			"                        WORD: size or mtime (age)\n" +
+			"  --iec                 like -h, but with KiB, MiB... units\n" +
+			"  --indicator-style=WORD\n" +
+			"                        append indicators in style WORD: none,\n" +
+			"                        slash (-p), file-type, classify (-F)\n" +
+			"  --jobs=N              stat up to N entries in parallel\n" +
+			"  --link-chain          show every hop of symlinks (with -l)\n" +
+			"  --literal             print names without quoting (-N)\n" +
+			"  --max-depth=N         like -R, but at most N levels deep\n" +
+			"  --nocolor             remove color formatting\n" +
+			"  --one-file-system     with -R, stay on the same file system\n" +
+			"  --print-colors        show the effective color configuration\n" +
+			"  --prune=PATTERN       with -R, skip directories like PATTERN\n" +
+			"  --quoting-style=WORD  quote names in style WORD: literal,\n" +
+			"                        shell, shell-always, shell-escape,\n" +
+			"                        shell-escape-always, c, escape\n" +
+			"  --si                  like -h, but use powers of 1000\n" +
+			"  --sort=WORD           sort by WORD: name, size, time, count\n" +
+			"  --stats[=FORMAT]      summarize the entries by type,\n" +
+			"                        extension, owner and age; FORMAT is\n" +
+			"                        text or json\n" +
+			"  --theme=FILE          take colors from a theme file\n" +
+			"  --time-style=STYLE    show times in STYLE: full-iso,\n" +
+			"                        long-iso, iso, locale, relative or\n" +
+			"                        +FORMAT\n" +
+			"  --timeout=DURATION    give up on any stat after DURATION\n" +
+			"  --top=N               list the N largest files below FILES\n" +
+			"                        (newest with -t, other end with -r)\n" +
+			"  --treemap             map the space taken by each entry,\n" +
+			"                        directories included, to the terminal\n" +
+			"  --tz=ZONE             show times in ZONE (UTC, Area/City)\n" +
+			"  -1                    one entry per line\n" +
+			"  -a                    include entries starting with '.'\n" +
+			"  -b                    escape non-printables and spaces\n" +
+			"  -C                    list entries in columns (tty default)\n" +
+			"  -d                    list directories like files\n" +
+			"  -F                    append one of */=@| to names by type\n" +
+			"  -g                    like -l, but without the owner\n" +
+			"  -G                    leave out the group in long listings\n" +
+			"  -h                    list sizes with human-readable units\n" +
+			"  -H                    follow symlinks given as arguments\n" +
+			"  -i                    print the inode number of each entry\n" +
+			"  -l                    long listing\n" +
+			"  -L                    show the targets of symlinks\n" +
+			"  -m                    list entries separated by commas\n" +
+			"  -n                    like -l, with numeric uids and gids\n" +
+			"  -N                    print names without quoting\n" +
+			"  -o                    like -l, but without the group\n" +
+			"  -p                    append / to directories\n" +
+			"  -q                    print '?' for non-printable characters\n" +
+			"  -Q                    enclose names in double quotes\n" +
+			"  -r                    reverse any sorting\n" +
+			"  -R                    list subdirectories recursively\n" +
+			"  -s                    print the allocated size of each entry\n" +
+			"  -t                    sort entries by modify time\n" +
+			"  -S                    sort entries by size\n" +
+			"  -x                    list entries in rows, not columns"
+		output.WriteString(helpStr)
+		return output.Flush()
 	}
 
 	//
 	// determine color output
 	//
 
-	if options.color {
+	if options.color || options.printColors {
 		colorMap = make(map[string]string)
 		colorMap["end"] = "\x1b[0m"
+		linkAsTarget = false
+		colorLeft = lsColorsDefaults["lc"]
+		colorRight = lsColorsDefaults["rc"]
 
 		LsColors := os.Getenv("LS_COLORS")
 		LSCOLORS := os.Getenv("LSCOLORS")
 
-		if LSCOLORS != "" {
-			parseLscolors(LSCOLORS)
-		} else if LsColors != "" {
-			// parse LS_COLORS
-			LsColorsSplit := strings.Split(LsColors, ":")
-			for _, i := range LsColorsSplit {
-				if i == "" {
-					continue
-				}
-
-				iSplit := strings.Split(i, "=")
-				colorCode := fmt.Sprintf("\x1b[%sm", iSplit[1])
-
-				if iSplit[0] == "rs" {
-					colorMap["end"] = colorCode
-				} else if iSplit[0] == "di" {
-					colorMap["directory"] = colorCode
-				} else if iSplit[0] == "ln" {
-					colorMap["symlink"] = colorCode
-				} else if iSplit[0] == "mh" {
-					colorMap["multi_hardlink"] = colorCode
-				} else if iSplit[0] == "pi" {
-					colorMap["pipe"] = colorCode
-				} else if iSplit[0] == "so" {
-					colorMap["socket"] = colorCode
-				} else if iSplit[0] == "bd" {
-					colorMap["block"] = colorCode
-				} else if iSplit[0] == "cd" {
-					colorMap["character"] = colorCode
-				} else if iSplit[0] == "or" {
-					colorMap["link_orphan"] = colorCode
-				} else if iSplit[0] == "mi" {
-					colorMap["link_orphan_target"] = colorCode
-				} else if iSplit[0] == "su" {
-					colorMap["executable_suid"] = colorCode
-				} else if iSplit[0] == "sg" {
-					colorMap["executable_sgid"] = colorCode
-				} else if iSplit[0] == "tw" {
-					colorMap["directory_o+w_sticky"] = colorCode
-				} else if iSplit[0] == "ow" {
-					colorMap["directory_o+w"] = colorCode
-				} else if iSplit[0] == "st" {
-					colorMap["directory_sticky"] = colorCode
-				} else if iSplit[0] == "ex" {
-					colorMap["executable"] = colorCode
-				} else {
-					colorMap[iSplit[0]] = colorCode
-				}
-
-				// ca - CAPABILITY? -- not supported!
-				// do - DOOR -- not supported!
+		if options.dircolors != "" {
+			dircolors, err := parseDircolorsFile(options.dircolors)
+			if err != nil {
+				return err
+			}
+			parseLsColors(dircolors)
+		} else if LSCOLORS != "" || LsColors != "" {
+			// with both, LSCOLORS still decides the types it has colors
+			// for, and LS_COLORS adds the others and the name patterns
+			if LsColors != "" {
+				parseLsColors(LsColors)
+			}
+			if LSCOLORS != "" {
+				parseLscolors(LSCOLORS)
 			}
 		} else {
 			// use the default LSCOLORS
 			parseLscolors("exfxcxdxbxegedabagacad")
 		}
+
+		for key, color := range columnColorsDefaults {
+			colorMap[key] = color
+		}
+
+		// a theme file goes on top of the colors from the environment
+		themePath := options.theme
+		if themePath == "" {
+			themePath = defaultThemePath()
+		}
+		if themePath != "" {
+			if err := loadTheme(themePath); err != nil {
+				return err
+			}
+		}
+	}
+
+	if options.color && options.colorColumns["owner"] {
+		loadCurrentUser()
+	}
+
+	if options.printColors {
+		printColors(output)
+		return output.Flush()
 	}
 
 	// if no files are specified, list the current directory
 	if len(argsFiles) == 0 {
-		thisDir, _ := os.Lstat(".")
+		thisDirListing := createTimedOutListing(".")
+		thisDir, err := lstatContext(ctx, ".")
 		//this_dir, _ := os.Stat(".")
-
-		thisDirListing, err := createListing("",
-			FileInfoPath{".", thisDir})
-		if err != nil {
+		if err != nil && err != errTimedOut {
 			return err
+		} else if err == nil {
+			thisDirListing, err = createListing(ctx, "",
+				FileInfoPath{".", thisDir})
+			if err != nil {
+				return err
+			}
 		}
 
 		// for option_dir (-d), treat the '.' directory like a regular file
@@ -1129,9 +2927,14 @@ func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
 	//
 	for _, f := range argsFiles {
 		//info, err := os.Stat(f)
-		info, err := os.Lstat(f)
+		info, err := statListing(ctx, f,
+			options.dereference || options.dereferenceArgs)
 
-		if err != nil && os.IsNotExist(err) {
+		if err == errTimedOut {
+			// the type is unknown, so list it like a file
+			listFiles = append(listFiles, createTimedOutListing(f))
+			continue
+		} else if err != nil && os.IsNotExist(err) {
 			return fmt.Errorf("cannot access %s: no such file or directory", f)
 		} else if err != nil && os.IsPermission(err) {
 			return fmt.Errorf("open %s: permission denied", f)
@@ -1139,7 +2942,7 @@ func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
 			return err
 		}
 
-		fListing, err := createListing("",
+		fListing, err := createListing(ctx, "",
 			FileInfoPath{f, info})
 		if err != nil {
 			return err
@@ -1160,6 +2963,60 @@ func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
 	numFiles := len(listFiles)
 	numDirs := len(listDirs)
 
+	jobs := options.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	statSlots = make(chan struct{}, jobs)
+
+	// the sizes of the arguments first, so the totals don't depend on the
+	// order the walker reads directories in
+	if options.dirSize {
+		dirSizeCache = make(map[[2]uint64][2]int64)
+		dirSizeSeen = make(map[[2]uint64]bool)
+		setDirSizes(ctx, "", listFiles)
+		setDirSizes(ctx, "", listDirs)
+	}
+
+	// with --top, list only the first files of the whole trees, by path
+	if options.top > 0 {
+		top, err := getTopListings(ctx, output, listFiles, listDirs,
+			options.top)
+		if err != nil {
+			return err
+		}
+		if len(top) > 0 {
+			writeListingsToBuffer(output, top, width)
+		}
+		return output.Flush()
+	}
+
+	// with --treemap, draw the space the entries take instead
+	if options.treemap {
+		err := writeTreemaps(ctx, output, listFiles, listDirs, width, height)
+		if err != nil {
+			return err
+		}
+		return output.Flush()
+	}
+
+	// with --histogram, chart the entries instead
+	if options.histogram != "" {
+		err := writeHistograms(ctx, output, listFiles, listDirs, width)
+		if err != nil {
+			return err
+		}
+		return output.Flush()
+	}
+
+	// with --stats, print a summary of the entries instead
+	if options.stats != "" {
+		if err := writeStats(ctx, output, listFiles, listDirs); err != nil {
+			return err
+		}
+		return output.Flush()
+	}
+
 	// sort the lists if necessary
 	sortListings(listFiles)
 	sortListings(listDirs)
@@ -1168,47 +3025,69 @@ func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
 	// list the files first (unless --dirs-first)
 	//
 	if numFiles > 0 && !options.dirsFirst {
-		writeListingsToBuffer(outputBuffer,
+		writeListingsToBuffer(output,
 			listFiles,
 			width)
+		if err := output.Flush(); err != nil {
+			return err
+		}
 	}
 
 	//
 	// then list the directories
 	//
-	if (numFiles > 0 && numDirs > 0) || (numDirs > 1) {
+	if (numFiles > 0 && numDirs > 0) || (numDirs > 1) || options.recursive {
 		if numFiles > 0 && !options.dirsFirst {
-			outputBuffer.WriteString("\n\n")
+			output.WriteString("\n\n")
 		}
 
-		for _, d := range listDirs {
-			writeListingName(outputBuffer, d)
-			outputBuffer.WriteString(":\n")
+		// the directories to list, in order; with -R, the subdirectories of a
+		// directory are listed right after it.  The walker reads the next
+		// directories in parallel while this one is written.
+		err := walkTree(ctx, output, listDirs,
+			func(dir queuedDir, listings []Listing, err error) error {
+				writeListingName(output, dir.listing)
+				output.WriteString(":")
+				output.deferString("\n")
+
+				if err != nil && dir.depth > 0 {
+					// a subdirectory that can't be read doesn't stop -R
+					warn(output, "cannot open directory %s: %v",
+						quoteName(dir.listing.name), err)
+					output.deferString("\n")
+					return nil
+				} else if err != nil {
+					return err
+				}
 
-			listings, err := listFilesInDir(d)
-			if err != nil {
-				return err
-			}
+				if options.dirsFirst {
+					listings = sortListingsDirsFirst(listings)
+				}
 
-			if options.dirsFirst {
-				listings = sortListingsDirsFirst(listings)
-			}
+				if options.long || options.blocks {
+					writeTotal(output, listings)
+				}
 
-			if len(listings) > 0 {
-				writeListingsToBuffer(outputBuffer,
-					listings,
-					width)
-				outputBuffer.WriteString("\n\n")
-			} else {
-				outputBuffer.WriteString("\n")
-			}
+				if len(listings) > 0 {
+					writeListingsToBuffer(output,
+						listings,
+						width)
+					output.deferString("\n\n")
+				} else {
+					output.deferString("\n")
+				}
+
+				return output.Flush()
+			})
+		if err != nil {
+			return err
 		}
 
-		outputBuffer.Truncate(outputBuffer.Len() - 2)
+		output.trimPending(2)
 	} else if numDirs == 1 {
 		for _, d := range listDirs {
 
-			listings, err := listFilesInDir(d)
+			listings, err := listFilesInDir(ctx, d)
 			if err != nil {
 				return err
 			}
@@ -1217,7 +3096,14 @@ func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
 				listings = sortListingsDirsFirst(listings)
 			}
 
-			writeListingsToBuffer(outputBuffer,
+			if options.long || options.blocks {
+				writeTotal(output, listings)
+				if len(listings) == 0 {
+					output.trimPending(1)
+				}
+			}
+
+			writeListingsToBuffer(output,
 				listings,
 				width)
 		}
@@ -1228,24 +3114,28 @@ func ls(outputBuffer *bytes.Buffer, args []string, width int) error {
 	//
 	if numFiles > 0 && options.dirsFirst {
 		if numDirs > 0 {
-			outputBuffer.WriteString("\n\n")
+			output.WriteString("\n\n")
 		}
-		writeListingsToBuffer(outputBuffer,
+		writeListingsToBuffer(output,
 			listFiles,
 			width)
 	}
 
-	return nil
+	return output.Flush()
 }
 
 // Main function
 func main() {
 	// capture the current terminal dimensions
-	terminalWidth, _, err := terminal.GetSize(int(os.Stdout.Fd()))
-	if err != nil {
+	// if stdout is not a terminal (e.g. ls | head), assume 80x24
+	terminalWidth, terminalHeight, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil && terminal.IsTerminal(int(os.Stdout.Fd())) {
 		fmt.Printf("error getting terminal dimensions\n")
 		fmt.Printf("%v\n", err)
 		os.Exit(1)
+	} else if err != nil {
+		terminalWidth = 80
+		terminalHeight = 24
 	}
 
 	var argumentList []string
@@ -1290,17 +3180,24 @@ func main() {
 		argumentList = os.Args
 	}
 
-	var outputBuffer bytes.Buffer
+	// A closed pipe (e.g. ls | head) should end the program quietly rather
+	// than kill it with SIGPIPE, so handle EPIPE on write instead.
+	signal.Ignore(syscall.SIGPIPE)
 
-	err = ls(&outputBuffer, argumentList[1:], terminalWidth)
-	if err != nil {
+	output := newOutputWriter(os.Stdout)
+
+	err = ls(context.Background(), output, argumentList[1:], terminalWidth,
+		terminalHeight)
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, syscall.EPIPE) {
+		os.Exit(1)
+	} else if err != nil {
 		fmt.Printf("ls: %v\n", err)
 		os.Exit(1)
 	}
-
-	if outputBuffer.String() != "" {
-		fmt.Printf("%s\n", outputBuffer.String())
-	}
 }
 
-// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
\ No newline at end of file
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run ls with the given arguments and return what it printed.
+func runLs(t *testing.T, args ...string) string {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	output := newOutputWriter(&buffer)
+	err := ls(context.Background(), output, args, 80, 24)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatalf("ls %s: %v", strings.Join(args, " "), err)
+	}
+
+	return buffer.String()
+}
+
+// Return the last field of every line, which is the name in long format.
+func getLastFields(text string) []string {
+	names := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			names = append(names, fields[len(fields)-1])
+		}
+	}
+
+	return names
+}
+
+// Create a file of the given size, along with the directories above it.
+func writeTestFile(t *testing.T, path string, size int) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirSizeHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "x", "deep", "linked"), 50000)
+	writeTestFile(t, filepath.Join(dir, "y", "other"), 7000)
+	err := os.Link(filepath.Join(dir, "x", "deep", "linked"),
+		filepath.Join(dir, "y", "linked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the sizes of the directories themselves
+	own := make(map[string]int64)
+	for _, name := range []string{"", "x", "x/deep", "y"} {
+		info, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		own[name] = info.Size()
+	}
+
+	// the size is the fifth column of the long format
+	sizes := make(map[string]int64)
+	output := runLs(t, "--dir-size", "-l", "--nocolor", dir)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n")[1:] {
+		fields := strings.Fields(line)
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			t.Fatalf("bad line %q", line)
+		}
+		sizes[fields[len(fields)-1]] = size
+	}
+	output = runLs(t, "--dir-size", "-ld", "--nocolor", dir)
+	total, err := strconv.ParseInt(strings.Fields(output)[4], 10, 64)
+	if err != nil {
+		t.Fatalf("bad line %q", output)
+	}
+
+	// the linked file is counted in x, where it is found first, and only once
+	// in the total
+	if want := own["x"] + own["x/deep"] + 50000; sizes["x"] != want {
+		t.Errorf("x is %d bytes, want %d", sizes["x"], want)
+	}
+	if want := own["y"] + 7000; sizes["y"] != want {
+		t.Errorf("y is %d bytes, want %d", sizes["y"], want)
+	}
+	if want := own[""] + sizes["x"] + sizes["y"]; total != want {
+		t.Errorf("the total is %d bytes, want %d", total, want)
+	}
+}
+
+func TestLinkChainSymlinkedParent(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "real", "final"), 10)
+	if err := os.Mkdir(filepath.Join(dir, "real", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// alias/.. is real, not dir, as alias leads to real/sub
+	links := [][2]string{
+		{"real/sub", "alias"},
+		{"../hop", "real/sub/start"},
+		{"final", "real/hop"},
+	}
+	for _, link := range links {
+		err := os.Symlink(link[0], filepath.Join(dir, link[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output := runLs(t, "-l", "--link-chain", "--nocolor",
+		filepath.Join(dir, "alias", "start"))
+	if !strings.HasSuffix(strings.TrimSpace(output), " -> ../hop -> final") {
+		t.Errorf("printed %q, want the chain to go through real/hop", output)
+	}
+}
+
+func TestListFilesInDirWithoutLs(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "file"), 0)
+
+	// without ls setting anything up first
+	listings, err := listFilesInDir(context.Background(), Listing{name: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 1 || listings[0].name != "file" {
+		t.Errorf("got %d listings, want only file", len(listings))
+	}
+}
+
+func TestCompareTies(t *testing.T) {
+	a := Listing{name: "a", sizeBytes: 10, epochNano: 5, countEntries: 2}
+	b := Listing{name: "B", sizeBytes: 10, epochNano: 5, countEntries: 2}
+	upper := Listing{name: "A", sizeBytes: 10, epochNano: 5, countEntries: 2}
+
+	compares := map[string]func(a, b Listing) int{"name": compareName,
+		"time": compareTime, "size": compareSize, "count": compareCount}
+	for key, compare := range compares {
+		if compare(a, a) != 0 {
+			t.Errorf("by %s, a file doesn't equal itself", key)
+		}
+		// ties by name, then by case
+		if compare(a, b) != -1 || compare(b, a) != 1 {
+			t.Errorf("by %s, a doesn't come before B", key)
+		}
+		if compare(upper, a) != -1 || compare(a, upper) != 1 {
+			t.Errorf("by %s, A doesn't come before a", key)
+		}
+	}
+}
+
+func TestSortNamesDifferingInCase(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b", "a", "B", "A"} {
+		writeTestFile(t, filepath.Join(dir, name), 0)
+	}
+
+	got := strings.Fields(runLs(t, "--nocolor", "-1", dir))
+	if strings.Join(got, " ") != "A a B b" {
+		t.Errorf("listed %v, want [A a B b]", got)
+	}
+}
+
+func TestListFilesInDirTimedOut(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "file"), 0)
+
+	// too short for any directory to be read in time
+	timeout := options.timeout
+	options.timeout = time.Nanosecond
+	defer func() { options.timeout = timeout }()
+
+	listings, err := listFilesInDir(context.Background(), Listing{name: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 1 || listings[0].name != "?" || !listings[0].timedOut {
+		t.Errorf("got %v, want only a placeholder", listings)
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.groupDigits = true
+
+	tests := map[int64]string{
+		0:        "0",
+		999:      "999",
+		1000:     "1,000",
+		123456:   "123,456",
+		1234567:  "1,234,567",
+		-1234567: "-1,234,567",
+	}
+	for n, want := range tests {
+		if got := formatNumber(n); got != want {
+			t.Errorf("formatNumber(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestParseBlockSize(t *testing.T) {
+	tests := []struct {
+		value  string
+		size   int64
+		suffix string
+	}{
+		{"512", 512, ""},
+		{"K", 1024, "K"},
+		{"KiB", 1024, "KiB"},
+		{"KB", 1000, "kB"},
+		{"4M", 4 << 20, ""},
+		{"4MB", 4000000, ""},
+		{"G", 1 << 30, "G"},
+		{"1E", 1 << 60, ""},
+	}
+	for _, test := range tests {
+		size, suffix, err := parseBlockSize(test.value)
+		if err != nil || size != test.size || suffix != test.suffix {
+			t.Errorf("parseBlockSize(%q) = %d, %q, %v, want %d, %q",
+				test.value, size, suffix, err, test.size, test.suffix)
+		}
+	}
+
+	for _, value := range []string{"", "0", "-1", "X", "KX", "4Mb"} {
+		if _, _, err := parseBlockSize(value); err == nil {
+			t.Errorf("parseBlockSize(%q) didn't fail", value)
+		}
+	}
+}
+
+func TestHumanSizes(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+
+	tests := []struct {
+		bytes          int64
+		human, si, iec string
+	}{
+		{0, "0B", "0B", "0B"},
+		{1000, "1000B", "1k", "1000B"},
+		{1500, "1.5K", "1.5k", "1.5KiB"},
+		{1234567, "1.2M", "1.2M", "1.2MiB"},
+	}
+	for _, test := range tests {
+		options.si, options.iec = false, false
+		human := formatHumanSize(test.bytes)
+		options.si = true
+		si := formatHumanSize(test.bytes)
+		options.si, options.iec = false, true
+		iec := formatHumanSize(test.bytes)
+
+		if human != test.human || si != test.si || iec != test.iec {
+			t.Errorf("%d bytes: got %s, %s and %s, want %s, %s and %s",
+				test.bytes, human, si, iec, test.human, test.si, test.iec)
+		}
+	}
+}
+
+func TestGroupedSizes(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "file"), 1234567)
+
+	for _, test := range [][2]string{
+		{"--block-size='1", "1,234,567"},
+		{"--block-size='K", "1,206K"},
+		{"--block-size=KB", "1235kB"},
+	} {
+		fields := strings.Fields(runLs(t, "-l", "--nocolor", test[0], dir))
+		if len(fields) < 5 || fields[len(fields)-5] != test[1] {
+			t.Errorf("%s printed %v, want the size %s", test[0], fields,
+				test[1])
+		}
+	}
+}
+
+func TestCountHidden(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{".hidden", "a", "b"} {
+		writeTestFile(t, filepath.Join(dir, "sub", name), 0)
+	}
+
+	// the count is the column after the size
+	for _, test := range [][]string{{"2"}, {"3", "-a"}} {
+		args := append(test[1:], "-l", "--count", "--nocolor", dir)
+		count := ""
+		for _, line := range strings.Split(runLs(t, args...), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 5 && fields[len(fields)-1] == "sub" {
+				count = fields[5]
+			}
+		}
+		if count != test[0] {
+			t.Errorf("ls %v counted %q entries in sub, want %s", test[1:],
+				count, test[0])
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
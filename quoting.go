@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The quoting styles accepted by --quoting-style, as in GNU ls.
+var quotingStyles = []string{
+	"literal", "shell", "shell-always", "shell-escape", "shell-escape-always",
+	"c", "escape",
+}
+
+// The characters that make a name need quoting for the shell.  '#' and '~'
+// are only special at the start of a name.
+const shellSpecialChars = " \t\n!\"$&'()*;<=>?[\\]^`{|}"
+
+// Report whether a character can be written to the terminal as it is.  Besides
+// the graphic characters this includes the zero width joiners and combining
+// marks of emoji and accented names, but not the bidirectional controls, which
+// could make a name look like a different one.
+func isPrintableRune(r rune) bool {
+	if (r >= 0x202a && r <= 0x202e) || (r >= 0x2066 && r <= 0x2069) {
+		return false
+	}
+
+	return unicode.IsPrint(r) || isZeroWidthRune(r)
+}
+
+// Split a name into runs of printable and non-printable characters.  Bytes
+// that aren't valid UTF-8 count as non-printable.
+func splitPrintable(name string) []string {
+	runs := make([]string, 0)
+	start := 0
+	lastPrintable := true
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		printable := !(r == utf8.RuneError && size == 1) && isPrintableRune(r)
+		if i > 0 && printable != lastPrintable {
+			runs = append(runs, name[start:i])
+			start = i
+		}
+		lastPrintable = printable
+		i += size
+	}
+
+	return append(runs, name[start:])
+}
+
+// Report whether the given run from splitPrintable is printable.
+func isPrintableRun(run string) bool {
+	r, size := utf8.DecodeRuneInString(run)
+	return !(r == utf8.RuneError && size <= 1) && isPrintableRune(r)
+}
+
+// Replace every non-printable character (and invalid byte) with '?', as -q
+// does.
+func hideControlChars(name string) string {
+	var hidden bytes.Buffer
+	for _, run := range splitPrintable(name) {
+		if isPrintableRun(run) {
+			hidden.WriteString(run)
+			continue
+		}
+		for i := 0; i < len(run); {
+			_, size := utf8.DecodeRuneInString(run[i:])
+			hidden.WriteByte('?')
+			i += size
+		}
+	}
+
+	return hidden.String()
+}
+
+// Escape a name with C-style backslash escapes: \n, \t, \\ and so on, with
+// octal escapes for other non-printable bytes.  With inQuotes, double quotes
+// are escaped; with escapeSpace, spaces are (as for the escape style).
+func cEscape(name string, inQuotes bool, escapeSpace bool) string {
+	var escaped bytes.Buffer
+	for _, run := range splitPrintable(name) {
+		if isPrintableRun(run) {
+			for _, r := range run {
+				if r == '\\' {
+					escaped.WriteString("\\\\")
+				} else if r == '"' && inQuotes {
+					escaped.WriteString("\\\"")
+				} else if r == ' ' && escapeSpace {
+					escaped.WriteString("\\ ")
+				} else {
+					escaped.WriteRune(r)
+				}
+			}
+			continue
+		}
+
+		for i := 0; i < len(run); i++ {
+			c := run[i]
+			if c == '\a' {
+				escaped.WriteString("\\a")
+			} else if c == '\b' {
+				escaped.WriteString("\\b")
+			} else if c == '\f' {
+				escaped.WriteString("\\f")
+			} else if c == '\n' {
+				escaped.WriteString("\\n")
+			} else if c == '\r' {
+				escaped.WriteString("\\r")
+			} else if c == '\t' {
+				escaped.WriteString("\\t")
+			} else if c == '\v' {
+				escaped.WriteString("\\v")
+			} else {
+				escaped.WriteString(fmt.Sprintf("\\%03o", c))
+			}
+		}
+	}
+
+	return escaped.String()
+}
+
+// Report whether a name has to be quoted to be used as a shell word.
+func needsShellQuoting(name string) bool {
+	if name == "" || name[0] == '#' || name[0] == '~' {
+		return true
+	}
+	if strings.ContainsAny(name, shellSpecialChars) {
+		return true
+	}
+	for _, run := range splitPrintable(name) {
+		if !isPrintableRun(run) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Quote a name for the shell, leaving it alone if it doesn't need quoting
+// (unless always is set).  Names whose only special character is a single
+// quote go in double quotes, everything else in single quotes.
+func shellQuote(name string, always bool) string {
+	if !always && !needsShellQuoting(name) {
+		return name
+	}
+
+	if strings.Contains(name, "'") && !strings.ContainsAny(name, "\"$`\\!") {
+		return "\"" + name + "\""
+	}
+
+	return "'" + strings.Replace(name, "'", "'\\''", -1) + "'"
+}
+
+// Quote a name for the shell, writing non-printable characters as $'\n' style
+// escapes so the result can be pasted back into a shell.
+func shellEscape(name string, always bool) string {
+	runs := splitPrintable(name)
+	if name == "" || (len(runs) == 1 && isPrintableRun(runs[0])) {
+		return shellQuote(name, always)
+	}
+
+	var quoted bytes.Buffer
+	for _, run := range runs {
+		if isPrintableRun(run) {
+			quoted.WriteString("'")
+			quoted.WriteString(strings.Replace(run, "'", "'\\''", -1))
+			quoted.WriteString("'")
+		} else {
+			quoted.WriteString("$'")
+			quoted.WriteString(cEscape(run, false, false))
+			quoted.WriteString("'")
+		}
+	}
+
+	return quoted.String()
+}
+
+// Return a file name the way it should be displayed, according to the quoting
+// style and -q.
+func quoteName(name string) string {
+	style := options.quotingStyle
+	if options.hideControl && (style == "literal" || style == "shell" ||
+		style == "shell-always") {
+		name = hideControlChars(name)
+	}
+
+	if style == "shell" {
+		return shellQuote(name, false)
+	} else if style == "shell-always" {
+		return shellQuote(name, true)
+	} else if style == "shell-escape" {
+		return shellEscape(name, false)
+	} else if style == "shell-escape-always" {
+		return shellEscape(name, true)
+	} else if style == "c" {
+		return "\"" + cEscape(name, true, false) + "\""
+	} else if style == "escape" {
+		return cEscape(name, false, true)
+	}
+
+	return name
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestQuotingStyleTerminal(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a\nb"), 0)
+	t.Setenv("QUOTING_STYLE", "literal")
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "a?b\n"},
+		{[]string{"-N"}, "a?b\n"},
+		{[]string{"-b"}, "a\\nb\n"},
+		{[]string{"--quoting-style=c"}, "\"a\\nb\"\n"},
+	}
+	for _, test := range tests {
+		// as if the output were a terminal
+		var buffer bytes.Buffer
+		output := newOutputWriter(&buffer)
+		output.isTerminal = true
+
+		args := append(test.args, "--nocolor", "-1", dir)
+		err := ls(context.Background(), output, args, 80, 24)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buffer.String() != test.want {
+			t.Errorf("ls %v printed %q, want %q", test.args, buffer.String(),
+				test.want)
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
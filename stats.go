@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Return the name of the file type of a listing in --stats.  The type comes
+// from the file type flags, as the permissions string only tells some of them
+// apart.
+func getStatsTypeName(l Listing) string {
+	if l.isSocket {
+		return "socket"
+	} else if l.isPipe {
+		return "fifo"
+	} else if l.isBlock {
+		return "block device"
+	} else if l.isCharacter {
+		return "character device"
+	} else if l.permissions[0] == 'd' {
+		return "directory"
+	} else if l.permissions[0] == 'l' {
+		return "symbolic link"
+	} else if l.permissions[0] == '-' {
+		return "regular file"
+	}
+
+	return "other"
+}
+
+// The age buckets of --stats, from the newest to the oldest.
+var statsAges = []struct {
+	name string
+	age  time.Duration
+}{
+	{"< 1 hour", time.Hour},
+	{"< 1 day", 24 * time.Hour},
+	{"< 1 week", 7 * 24 * time.Hour},
+	{"< 30 days", 30 * 24 * time.Hour},
+	{"< 1 year", 365 * 24 * time.Hour},
+	{">= 1 year", math.MaxInt64},
+}
+
+// The number and total size of the entries of one type, extension, owner or
+// age in --stats.
+type statsBucket struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Bytes int64  `json:"bytes"`
+	Size  string `json:"size"`
+}
+
+// An entry singled out by --stats, such as the largest file.
+type statsEntry struct {
+	Path     string `json:"path"`
+	Bytes    int64  `json:"bytes"`
+	Size     string `json:"size"`
+	Modified string `json:"modified"`
+}
+
+// The summary printed by --stats.
+type statsReport struct {
+	Entries    int           `json:"entries"`
+	Bytes      int64         `json:"bytes"`
+	Size       string        `json:"size"`
+	Types      []statsBucket `json:"types"`
+	Extensions []statsBucket `json:"extensions"`
+	Owners     []statsBucket `json:"owners"`
+	Ages       []statsBucket `json:"ages"`
+	Largest    *statsEntry   `json:"largest"`
+	Oldest     *statsEntry   `json:"oldest"`
+}
+
+// Collects the listings that go into a statsReport.
+type statsCollector struct {
+	now        time.Time
+	entries    int
+	bytes      int64
+	types      map[string]*statsBucket
+	extensions map[string]*statsBucket
+	owners     map[string]*statsBucket
+	ages       []statsBucket
+	largest    *Listing
+	oldest     *Listing
+}
+
+// Create an empty stats collector.
+func newStatsCollector() *statsCollector {
+	c := &statsCollector{
+		now:        time.Now(),
+		types:      make(map[string]*statsBucket),
+		extensions: make(map[string]*statsBucket),
+		owners:     make(map[string]*statsBucket),
+	}
+	for _, a := range statsAges {
+		c.ages = append(c.ages, statsBucket{Name: a.name})
+	}
+
+	return c
+}
+
+// Count a listing in the bucket of the given name, creating it if necessary.
+func addToBucket(buckets map[string]*statsBucket, name string, l Listing) {
+	b, ok := buckets[name]
+	if !ok {
+		b = &statsBucket{Name: name}
+		buckets[name] = b
+	}
+	b.Count++
+	b.Bytes += l.sizeBytes
+}
+
+// Add a listing, whose name is its path, to the statistics.
+func (c *statsCollector) add(l Listing) {
+	if l.timedOut {
+		return
+	}
+
+	c.entries++
+	c.bytes += l.sizeBytes
+
+	typeName := getStatsTypeName(l)
+	addToBucket(c.types, typeName, l)
+
+	if typeName == "regular file" {
+		// a dotfile like .bashrc has no extension
+		extension := filepath.Ext(l.name)
+		if extension == "" || extension == filepath.Base(l.name) {
+			extension = "(none)"
+		} else {
+			extension = strings.ToLower(extension)
+		}
+		addToBucket(c.extensions, extension, l)
+	}
+
+	addToBucket(c.owners, l.owner, l)
+
+	age := c.now.Sub(time.Unix(0, l.epochNano))
+	for i, a := range statsAges {
+		if age < a.age || i == len(statsAges)-1 {
+			c.ages[i].Count++
+			c.ages[i].Bytes += l.sizeBytes
+			break
+		}
+	}
+
+	if l.permissions[0] != 'd' &&
+		(c.largest == nil || l.sizeBytes > c.largest.sizeBytes) {
+		largest := l
+		c.largest = &largest
+	}
+	if c.oldest == nil || l.epochNano < c.oldest.epochNano {
+		oldest := l
+		c.oldest = &oldest
+	}
+}
+
+// Return the buckets with sizes filled in, the largest first.
+func sortBuckets(buckets map[string]*statsBucket) []statsBucket {
+	sorted := make([]statsBucket, 0, len(buckets))
+	for _, b := range buckets {
+		b.Size = formatSize(b.Bytes)
+		sorted = append(sorted, *b)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Bytes != sorted[j].Bytes {
+			return sorted[i].Bytes > sorted[j].Bytes
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	return sorted
+}
+
+// Return the entry for a listing singled out in the report, or nil.
+func getStatsEntry(l *Listing) *statsEntry {
+	if l == nil {
+		return nil
+	}
+
+	modified := time.Unix(0, l.epochNano)
+	if options.location != nil {
+		modified = modified.In(options.location)
+	}
+
+	return &statsEntry{l.name, l.sizeBytes, formatSize(l.sizeBytes),
+		modified.Format(time.RFC3339)}
+}
+
+// Return the report of everything collected so far.
+func (c *statsCollector) report() statsReport {
+	ages := make([]statsBucket, 0, len(c.ages))
+	for _, a := range c.ages {
+		if a.Count > 0 {
+			a.Size = formatSize(a.Bytes)
+			ages = append(ages, a)
+		}
+	}
+
+	return statsReport{
+		Entries:    c.entries,
+		Bytes:      c.bytes,
+		Size:       formatSize(c.bytes),
+		Types:      sortBuckets(c.types),
+		Extensions: sortBuckets(c.extensions),
+		Owners:     sortBuckets(c.owners),
+		Ages:       ages,
+		Largest:    getStatsEntry(c.largest),
+		Oldest:     getStatsEntry(c.oldest),
+	}
+}
+
+// Return one table of the text report, with the given title over the names.
+func formatStatsTable(title string, buckets []statsBucket) string {
+	nameWidth := displayWidth(title)
+	countWidth := len("Count")
+	sizeWidth := len("Size")
+	for _, b := range buckets {
+		if displayWidth(quoteName(b.Name)) > nameWidth {
+			nameWidth = displayWidth(quoteName(b.Name))
+		}
+		if len(formatNumber(int64(b.Count))) > countWidth {
+			countWidth = len(formatNumber(int64(b.Count)))
+		}
+		if len(b.Size) > sizeWidth {
+			sizeWidth = len(b.Size)
+		}
+	}
+
+	pad := func(s string, width int) string {
+		for n := displayWidth(s); n < width; n++ {
+			s += " "
+		}
+		return s
+	}
+	table := fmt.Sprintf("%s  %*s  %*s\n", pad(title, nameWidth),
+		countWidth, "Count", sizeWidth, "Size")
+	for _, b := range buckets {
+		table += fmt.Sprintf("%s  %*s  %*s\n",
+			pad(quoteName(b.Name), nameWidth),
+			countWidth, formatNumber(int64(b.Count)), sizeWidth, b.Size)
+	}
+
+	return table
+}
+
+// Write a report in the format given to --stats: "text" or "json".
+func writeStatsReport(output *outputWriter, report statsReport,
+	format string) error {
+	if format == "json" {
+		var encoded bytes.Buffer
+		encoder := json.NewEncoder(&encoded)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+		output.WriteString(strings.TrimSuffix(encoded.String(), "\n"))
+		return nil
+	}
+
+	text := fmt.Sprintf("%s entries, %s\n\n",
+		formatNumber(int64(report.Entries)), report.Size)
+	text += formatStatsTable("Type", report.Types)
+	if len(report.Extensions) > 0 {
+		text += "\n" + formatStatsTable("Extension", report.Extensions)
+	}
+	text += "\n" + formatStatsTable("Owner", report.Owners)
+	text += "\n" + formatStatsTable("Age", report.Ages)
+
+	if report.Largest != nil || report.Oldest != nil {
+		text += "\n"
+	}
+	if report.Largest != nil {
+		text += fmt.Sprintf("Largest  %s (%s)\n",
+			quoteName(report.Largest.Path), report.Largest.Size)
+	}
+	if report.Oldest != nil {
+		text += fmt.Sprintf("Oldest   %s (%s)\n",
+			quoteName(report.Oldest.Path), report.Oldest.Modified)
+	}
+
+	// the last newline is written when the output is closed
+	output.WriteString(strings.TrimSuffix(text, "\n"))
+
+	return nil
+}
+
+// Print the --stats summary of the given files and of the contents of the
+// given directories (their whole trees with -R).
+func writeStats(ctx context.Context, output *outputWriter,
+	files []Listing, dirs []Listing) error {
+	stats := newStatsCollector()
+	for _, l := range files {
+		stats.add(l)
+	}
+
+	err := walkListings(ctx, output, dirs,
+		func(dir Listing, listings []Listing) {
+			for _, l := range listings {
+				if l.name == "." || l.name == ".." {
+					continue
+				}
+				l.name = filepath.Join(dir.name, l.name)
+				stats.add(l)
+			}
+		})
+	if err != nil {
+		return err
+	}
+
+	return writeStatsReport(output, stats.report(), options.stats)
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStatsTypes(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "file.txt"), 10)
+	socket, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Skipf("cannot create a socket: %v", err)
+	}
+	defer socket.Close()
+
+	var report statsReport
+	err = json.Unmarshal([]byte(runLs(t, "--stats=json", dir)), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := make(map[string]int)
+	for _, b := range report.Types {
+		types[b.Name] = b.Count
+	}
+	if types["socket"] != 1 || types["regular file"] != 1 || len(types) != 2 {
+		t.Errorf("got types %v, want one socket and one regular file", types)
+	}
+}
+
+func TestStatsExtensions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{".Xresources", "a.TXT", "b.txt", "c"} {
+		writeTestFile(t, filepath.Join(dir, name), 10)
+	}
+
+	var report statsReport
+	err := json.Unmarshal([]byte(runLs(t, "-a", "--stats=json", dir)), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extensions := make(map[string]int)
+	for _, b := range report.Extensions {
+		extensions[b.Name] = b.Count
+	}
+	want := map[string]int{"(none)": 2, ".txt": 2}
+	if !reflect.DeepEqual(extensions, want) {
+		t.Errorf("got extensions %v, want %v", extensions, want)
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
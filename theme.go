@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An entry from a theme file, like `di = { fg = "#5f87ff", bold = true }` in
+// the [types] table.  A plain value instead of an inline table is taken as the
+// foreground color.
+type themeEntry struct {
+	table  string            // the [table] the entry is in
+	key    string            // the file type, extension or name pattern
+	fields map[string]string // fg, bg, bold, italic, underline
+	line   int
+}
+
+// The names of the basic ANSI colors, in the order of their color codes.
+var themeColorNames = []string{
+	"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white",
+}
+
+// The RGB values of the 16 basic colors as xterm shows them, used to map 256
+// colors and 24-bit colors to the nearest basic color.
+var basicColorsRGB = [16][3]int{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// Return the path of the default theme file, $XDG_CONFIG_HOME/ls/theme.toml
+// (~/.config/ls/theme.toml), or "" if there is none.
+func defaultThemePath() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return ""
+		}
+		configDir = home + "/.config"
+	}
+
+	path := configDir + "/ls/theme.toml"
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+
+	return path
+}
+
+// Split a string at every sep that isn't inside quotes.
+func splitOutsideQuotes(s string, sep byte) []string {
+	parts := make([]string, 0)
+	var quote byte // the quote character of the current string, if any
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if quote == 0 && (s[i] == '"' || s[i] == '\'') {
+			quote = s[i]
+		} else if s[i] == quote && (quote == '\'' || s[i-1] != '\\') {
+			quote = 0
+		} else if s[i] == sep && quote == 0 {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// Remove the quotes around a TOML key or string value.  Bare keys and numbers
+// are returned unchanged.
+func unquoteThemeValue(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "'") && strings.HasSuffix(s, "'") && len(s) > 1 {
+		return s[1 : len(s)-1], nil
+	} else if strings.HasPrefix(s, "\"") {
+		return strconv.Unquote(s)
+	}
+
+	return s, nil
+}
+
+// Parse a theme file, which uses a subset of TOML: [tables], comments and
+// `key = value` lines, where the value is a string, a number or an inline table
+// of those.
+func parseThemeFile(path string) ([]themeEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]themeEntry, 0)
+	table := ""
+	lineNumber := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNumber++
+		line := splitOutsideQuotes(scanner.Text(), '#')[0]
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		} else if line[0] == '[' && line[len(line)-1] == ']' {
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		keyValue := splitOutsideQuotes(line, '=')
+		if len(keyValue) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value",
+				path, lineNumber)
+		}
+		key, err := unquoteThemeValue(keyValue[0])
+		if err != nil || key == "" {
+			return nil, fmt.Errorf("%s:%d: invalid key", path, lineNumber)
+		}
+		value := strings.TrimSpace(strings.Join(keyValue[1:], "="))
+
+		entry := themeEntry{table, key, make(map[string]string), lineNumber}
+		if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
+			fields := value[1 : len(value)-1]
+			for _, field := range splitOutsideQuotes(fields, ',') {
+				if strings.TrimSpace(field) == "" {
+					continue
+				}
+				fieldSplit := splitOutsideQuotes(field, '=')
+				if len(fieldSplit) != 2 {
+					return nil, fmt.Errorf("%s:%d: invalid field %q",
+						path, lineNumber, strings.TrimSpace(field))
+				}
+				fieldKey, err := unquoteThemeValue(fieldSplit[0])
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+				}
+				fieldValue, err := unquoteThemeValue(fieldSplit[1])
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+				}
+				entry.fields[fieldKey] = fieldValue
+			}
+		} else {
+			fg, err := unquoteThemeValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+			}
+			entry.fields["fg"] = fg
+		}
+
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Report whether the terminal advertises 24-bit color support.
+func trueColorSupported() bool {
+	colorTerm := os.Getenv("COLORTERM")
+	return colorTerm == "truecolor" || colorTerm == "24bit"
+}
+
+// Convert one of the 256 colors to its RGB value in the xterm palette.
+func color256ToRGB(n int) [3]int {
+	if n < 16 {
+		return basicColorsRGB[n]
+	} else if n < 232 {
+		levels := []int{0, 95, 135, 175, 215, 255}
+		n -= 16
+		return [3]int{levels[n/36], levels[(n/6)%6], levels[n%6]}
+	}
+
+	gray := 8 + 10*(n-232)
+	return [3]int{gray, gray, gray}
+}
+
+// Return the index (0-15) of the basic color closest to the given RGB value.
+func nearestBasicColor(rgb [3]int) int {
+	nearest := 0
+	nearestDistance := -1
+	for i, basic := range basicColorsRGB {
+		distance := 0
+		for c := 0; c < 3; c++ {
+			distance += (rgb[c] - basic[c]) * (rgb[c] - basic[c])
+		}
+		if nearestDistance < 0 || distance < nearestDistance {
+			nearest = i
+			nearestDistance = distance
+		}
+	}
+
+	return nearest
+}
+
+// Return the SGR parameters for one of the 16 basic colors.
+func basicColorCode(n int, foreground bool) string {
+	base := 30
+	if n >= 8 {
+		base = 90
+		n -= 8
+	}
+	if !foreground {
+		base += 10
+	}
+
+	return strconv.Itoa(base + n)
+}
+
+// Convert a theme color to SGR parameters: a color name ("red",
+// "bright-blue"), a number of the 256-color palette or "#rrggbb".  Without
+// truecolor support, every color is downgraded to the nearest basic color.
+func themeColorCode(value string, foreground bool) (string, error) {
+	value = strings.ToLower(value)
+
+	for i, name := range themeColorNames {
+		if value == name {
+			return basicColorCode(i, foreground), nil
+		} else if value == "bright-"+name || value == "bright"+name {
+			return basicColorCode(i+8, foreground), nil
+		}
+	}
+
+	kind := "38"
+	if !foreground {
+		kind = "48"
+	}
+
+	if n, err := strconv.Atoi(value); err == nil && n >= 0 && n <= 255 {
+		if n < 16 {
+			return basicColorCode(n, foreground), nil
+		} else if !trueColorSupported() {
+			return basicColorCode(
+				nearestBasicColor(color256ToRGB(n)), foreground), nil
+		}
+		return fmt.Sprintf("%s;5;%d", kind, n), nil
+	}
+
+	if len(value) == 7 && value[0] == '#' {
+		rgbValue, err := strconv.ParseUint(value[1:], 16, 32)
+		if err == nil {
+			rgb := [3]int{
+				int(rgbValue >> 16), int((rgbValue >> 8) & 0xff),
+				int(rgbValue & 0xff),
+			}
+			if !trueColorSupported() {
+				return basicColorCode(nearestBasicColor(rgb), foreground), nil
+			}
+			return fmt.Sprintf("%s;2;%d;%d;%d", kind,
+				rgb[0], rgb[1], rgb[2]), nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid color %q", value)
+}
+
+// Convert the fields of a theme entry to an escape sequence like
+// "\x1b[1;38;5;75m".
+func themeStyleCode(fields map[string]string) (string, error) {
+	params := make([]string, 0)
+
+	attributes := []struct {
+		name string
+		code string
+	}{{"bold", "1"}, {"italic", "3"}, {"underline", "4"}}
+	for _, a := range attributes {
+		if fields[a.name] == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(fields[a.name])
+		if err != nil {
+			return "", fmt.Errorf("invalid value for %s: %q",
+				a.name, fields[a.name])
+		}
+		if enabled {
+			params = append(params, a.code)
+		}
+	}
+
+	if fields["fg"] != "" {
+		fg, err := themeColorCode(fields["fg"], true)
+		if err != nil {
+			return "", err
+		}
+		params = append(params, fg)
+	}
+	if fields["bg"] != "" {
+		bg, err := themeColorCode(fields["bg"], false)
+		if err != nil {
+			return "", err
+		}
+		params = append(params, bg)
+	}
+
+	if len(params) == 0 {
+		return "", nil
+	}
+
+	return fmt.Sprintf("\x1b[%sm", strings.Join(params, ";")), nil
+}
+
+// Load a theme file and apply it on top of the current colorMap.  File types go
+// in [types] (e.g. "directory" or "di"), extensions in [extensions] (e.g.
+// "tar.gz") and other LS_COLORS style name patterns in [patterns].  Theme
+// patterns take precedence over the ones from LS_COLORS.  The [columns] table
+// holds the --color-columns colors (e.g. "perm_read" or "size_giga").
+func loadTheme(path string) error {
+	entries, err := parseThemeFile(path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		code, err := themeStyleCode(entry.fields)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, entry.line, err)
+		}
+
+		if entry.table == "types" {
+			name := entry.key
+			if lsColorsKeys[name] != "" {
+				name = lsColorsKeys[name]
+			}
+
+			known := false
+			for _, typeName := range lsColorsKeys {
+				if name == typeName {
+					known = true
+				}
+			}
+			if !known {
+				return fmt.Errorf("%s:%d: unknown file type %q",
+					path, entry.line, entry.key)
+			}
+
+			colorMap[name] = code
+		} else if entry.table == "extensions" {
+			pattern := "*." + strings.TrimPrefix(entry.key, ".")
+			colorPatterns = append(colorPatterns, colorPattern{
+				pattern:      pattern,
+				patternLower: strings.ToLower(pattern),
+				color:        code,
+			})
+		} else if entry.table == "columns" {
+			if _, ok := columnColorsDefaults["column_"+entry.key]; !ok {
+				return fmt.Errorf("%s:%d: unknown column color %q",
+					path, entry.line, entry.key)
+			}
+			colorMap["column_"+entry.key] = code
+		} else if entry.table == "patterns" {
+			colorPatterns = append(colorPatterns, colorPattern{
+				pattern:      entry.key,
+				patternLower: strings.ToLower(entry.key),
+				color:        code,
+			})
+		} else {
+			return fmt.Errorf("%s:%d: unknown table [%s]",
+				path, entry.line, entry.table)
+		}
+	}
+
+	return nil
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
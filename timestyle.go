@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The time styles accepted by --time-style, besides +FORMAT.
+var timeStyles = []string{"full-iso", "long-iso", "iso", "locale", "relative"}
+
+// The abbreviated month names of the locales we know, by language, as the C
+// library of those locales writes them.  Other locales use the English ones.
+var localeMonthNames = map[string][]string{
+	"cs": {"led", "úno", "bře", "dub", "kvě", "čvn", "čvc", "srp", "zář",
+		"říj", "lis", "pro"},
+	"da": {"jan", "feb", "mar", "apr", "maj", "jun", "jul", "aug", "sep",
+		"okt", "nov", "dec"},
+	"de": {"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep",
+		"Okt", "Nov", "Dez"},
+	"es": {"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sep",
+		"oct", "nov", "dic"},
+	"fi": {"tammi", "helmi", "maalis", "huhti", "touko", "kesä", "heinä",
+		"elo", "syys", "loka", "marras", "joulu"},
+	"fr": {"janv.", "févr.", "mars", "avril", "mai", "juin", "juil.",
+		"août", "sept.", "oct.", "nov.", "déc."},
+	"it": {"gen", "feb", "mar", "apr", "mag", "giu", "lug", "ago", "set",
+		"ott", "nov", "dic"},
+	"ja": {"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月",
+		"10月", "11月", "12月"},
+	"ko": {"1월", "2월", "3월", "4월", "5월", "6월", "7월", "8월", "9월",
+		"10월", "11월", "12월"},
+	"nb": {"jan", "feb", "mar", "apr", "mai", "jun", "jul", "aug", "sep",
+		"okt", "nov", "des"},
+	"nl": {"jan", "feb", "mrt", "apr", "mei", "jun", "jul", "aug", "sep",
+		"okt", "nov", "dec"},
+	"pl": {"sty", "lut", "mar", "kwi", "maj", "cze", "lip", "sie", "wrz",
+		"paź", "lis", "gru"},
+	"pt": {"jan", "fev", "mar", "abr", "mai", "jun", "jul", "ago", "set",
+		"out", "nov", "dez"},
+	"ru": {"янв", "фев", "мар", "апр", "мая", "июн", "июл", "авг", "сен",
+		"окт", "ноя", "дек"},
+	"sv": {"jan", "feb", "mar", "apr", "maj", "jun", "jul", "aug", "sep",
+		"okt", "nov", "dec"},
+	"tr": {"Oca", "Şub", "Mar", "Nis", "May", "Haz", "Tem", "Ağu", "Eyl",
+		"Eki", "Kas", "Ara"},
+	"zh": {"1月", "2月", "3月", "4月", "5月", "6月", "7月", "8月", "9月",
+		"10月", "11月", "12月"},
+}
+
+// Return the abbreviated month names of the LC_TIME locale, taken from LC_ALL,
+// then LC_TIME, then LANG, or nil for the English names of the C locale.  The
+// names come from localeMonthNames rather than the system's locale data, by
+// language only: a regional variant like pt_BR gets the pt names, and C, POSIX
+// and the languages missing from the table fall back to C.
+func getLocaleMonthNames() []string {
+	locale := os.Getenv("LC_ALL")
+	if locale == "" {
+		locale = os.Getenv("LC_TIME")
+	}
+	if locale == "" {
+		locale = os.Getenv("LANG")
+	}
+
+	// e.g. "de_DE.UTF-8" -> "de"; "no" is an old name for Norwegian Bokmål
+	language := strings.SplitN(strings.SplitN(locale, ".", 2)[0], "_", 2)[0]
+	if language == "no" {
+		language = "nb"
+	}
+
+	return localeMonthNames[language]
+}
+
+// Return the abbreviated name of the month of a time in the current locale.
+func getMonthName(t time.Time) string {
+	if options.monthNames != nil {
+		return options.monthNames[t.Month()-1]
+	}
+
+	return t.Month().String()[0:3]
+}
+
+// The strftime conversions that map directly to a Go time layout.
+var strftimeLayouts = map[byte]string{
+	'a': "Mon",
+	'A': "Monday",
+	'b': "Jan",
+	'B': "January",
+	'd': "02",
+	'D': "01/02/06",
+	'e': "_2",
+	'F': "2006-01-02",
+	'h': "Jan",
+	'H': "15",
+	'I': "03",
+	'm': "01",
+	'M': "04",
+	'p': "PM",
+	'R': "15:04",
+	'S': "05",
+	'T': "15:04:05",
+	'y': "06",
+	'Y': "2006",
+	'z': "-0700",
+	'Z': "MST",
+}
+
+// Format a time like C's strftime does, with the GNU %N (nanoseconds) and %s
+// (seconds since the epoch) extensions.  The abbreviated month (%b) follows the
+// locale.  Unknown conversions are copied as they are.
+func strftime(t time.Time, format string) string {
+	var formatted bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			formatted.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		c := format[i]
+		if c == 'b' || c == 'h' {
+			formatted.WriteString(getMonthName(t))
+		} else if layout, ok := strftimeLayouts[c]; ok {
+			formatted.WriteString(t.Format(layout))
+		} else if c == 'N' {
+			formatted.WriteString(fmt.Sprintf("%09d", t.Nanosecond()))
+		} else if c == 's' {
+			formatted.WriteString(fmt.Sprintf("%d", t.Unix()))
+		} else if c == 'j' {
+			formatted.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		} else if c == 'k' {
+			formatted.WriteString(fmt.Sprintf("%2d", t.Hour()))
+		} else if c == 'l' {
+			formatted.WriteString(fmt.Sprintf("%2d", (t.Hour()+11)%12+1))
+		} else if c == 'u' {
+			formatted.WriteString(fmt.Sprintf("%d", (int(t.Weekday())+6)%7+1))
+		} else if c == 'w' {
+			formatted.WriteString(fmt.Sprintf("%d", int(t.Weekday())))
+		} else if c == 'n' {
+			formatted.WriteByte('\n')
+		} else if c == 't' {
+			formatted.WriteByte('\t')
+		} else if c == '%' {
+			formatted.WriteByte('%')
+		} else {
+			formatted.WriteByte('%')
+			formatted.WriteByte(c)
+		}
+	}
+
+	return formatted.String()
+}
+
+// Report whether a time is recent: less than six months old and not in the
+// future.  Recent times show the hour and minute, older ones the year.
+func isRecentTime(t time.Time, now time.Time) bool {
+	var secondsInSixMonths int64 = 182 * 24 * 60 * 60
+	epochSixMonthsAgo := now.Unix() - secondsInSixMonths
+
+	return t.Unix() > epochSixMonthsAgo && t.Unix() < now.Unix()+5
+}
+
+// Format a time relative to now, like "3h ago" or "in 5m".
+func formatRelativeTime(t time.Time, now time.Time) string {
+	seconds := int64(now.Sub(t) / time.Second)
+	future := seconds < 0
+	if future {
+		seconds = -seconds
+	}
+
+	if seconds < 1 {
+		return "just now"
+	}
+
+	units := []struct {
+		suffix  string
+		seconds int64
+	}{
+		{"y", 365 * 24 * 60 * 60}, {"mo", 30 * 24 * 60 * 60},
+		{"w", 7 * 24 * 60 * 60}, {"d", 24 * 60 * 60}, {"h", 60 * 60},
+		{"m", 60}, {"s", 1},
+	}
+	relative := ""
+	for _, unit := range units {
+		if seconds >= unit.seconds {
+			relative = fmt.Sprintf("%d%s", seconds/unit.seconds, unit.suffix)
+			break
+		}
+	}
+
+	if future {
+		return "in " + relative
+	}
+	return relative + " ago"
+}
+
+// Report whether the time is shown in the classic month, day and time/year
+// columns, as opposed to a single column in one of the other --time-style
+// styles.
+func isDefaultTimeStyle() bool {
+	return options.timeStyle == "" || options.timeStyle == "locale"
+}
+
+// Return the modification time of a listing in the current --time-style and
+// --tz, with recent times judged from now.  The default style uses the month,
+// day and time (or year) columns; the other styles return the whole time as
+// the last value, with empty month and day.
+func formatListingTime(t time.Time, now time.Time) (string, string, string) {
+	style := options.timeStyle
+	if options.location != nil {
+		t = t.In(options.location)
+	}
+
+	if isDefaultTimeStyle() {
+		month := getMonthName(t)
+		day := fmt.Sprintf("%02d", t.Day())
+		if isRecentTime(t, now) {
+			return month, day, fmt.Sprintf("%02d:%02d", t.Hour(), t.Minute())
+		}
+		return month, day, fmt.Sprintf("%d", t.Year())
+	} else if style == "full-iso" {
+		return "", "", strftime(t, "%Y-%m-%d %H:%M:%S.%N %z")
+	} else if style == "long-iso" {
+		return "", "", strftime(t, "%Y-%m-%d %H:%M")
+	} else if style == "iso" {
+		if isRecentTime(t, now) {
+			return "", "", strftime(t, "%m-%d %H:%M")
+		}
+		return "", "", strftime(t, "%Y-%m-%d ")
+	} else if style == "relative" {
+		return "", "", formatRelativeTime(t, now)
+	}
+
+	// +FORMAT, or +OLD_FORMAT\nRECENT_FORMAT
+	formats := strings.SplitN(style[1:], "\n", 2)
+	if len(formats) == 2 && isRecentTime(t, now) {
+		return "", "", strftime(t, formats[1])
+	}
+	return "", "", strftime(t, formats[0])
+}
+
+// Check a --time-style value, returning it without the "posix-" prefix that
+// GNU ls accepts.
+func parseTimeStyle(style string) (string, error) {
+	style = strings.TrimPrefix(style, "posix-")
+	if strings.HasPrefix(style, "+") {
+		return style, nil
+	}
+
+	for _, name := range timeStyles {
+		if style == name {
+			return style, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid time style: %s", style)
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeStyle(t *testing.T) {
+	tests := map[string]string{
+		"full-iso":       "full-iso",
+		"long-iso":       "long-iso",
+		"iso":            "iso",
+		"locale":         "locale",
+		"relative":       "relative",
+		"posix-long-iso": "long-iso",
+		"+%Y %b":         "+%Y %b",
+		"+%Y\\n%H:%M":    "+%Y\\n%H:%M",
+	}
+	for value, want := range tests {
+		if got, err := parseTimeStyle(value); err != nil || got != want {
+			t.Errorf("parseTimeStyle(%q) = %q, %v, want %q", value, got,
+				err, want)
+		}
+	}
+
+	for _, value := range []string{"", "iso8601", "posix-", "ISO"} {
+		if _, err := parseTimeStyle(value); err == nil {
+			t.Errorf("parseTimeStyle(%q) didn't fail", value)
+		}
+	}
+}
+
+func TestFormatListingTime(t *testing.T) {
+	saved := options
+	defer func() { options = saved }()
+	options.location = time.FixedZone("CEST", 2*60*60)
+	options.monthNames = nil
+
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	recent := now.Add(-150*time.Minute + 123456789)
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	future := now.Add(5 * time.Minute)
+
+	tests := []struct {
+		style string
+		t     time.Time
+		want  [3]string
+	}{
+		{"", recent, [3]string{"Jun", "15", "11:30"}},
+		{"", old, [3]string{"Jan", "02", "2020"}},
+		{"locale", old, [3]string{"Jan", "02", "2020"}},
+		{"full-iso", recent,
+			[3]string{"", "", "2024-06-15 11:30:00.123456789 +0200"}},
+		{"long-iso", old, [3]string{"", "", "2020-01-02 05:04"}},
+		{"iso", recent, [3]string{"", "", "06-15 11:30"}},
+		{"iso", old, [3]string{"", "", "2020-01-02 "}},
+		{"relative", recent, [3]string{"", "", "2h ago"}},
+		{"relative", future, [3]string{"", "", "in 5m"}},
+		{"relative", now, [3]string{"", "", "just now"}},
+		{"+%Y/%m/%d %Z %%", recent, [3]string{"", "", "2024/06/15 CEST %"}},
+		{"+%Y\n%H:%M", recent, [3]string{"", "", "11:30"}},
+		{"+%Y\n%H:%M", old, [3]string{"", "", "2020"}},
+	}
+	for _, test := range tests {
+		options.timeStyle = test.style
+		month, day, clock := formatListingTime(test.t, now)
+		if got := [3]string{month, day, clock}; got != test.want {
+			t.Errorf("%q of %v: got %q, want %q", test.style, test.t, got,
+				test.want)
+		}
+	}
+}
+
+func TestTimeStyleEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	writeTestFile(t, path, 0)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		env  string
+		args []string
+		want string
+	}{
+		{"long-iso", nil, " 2020-01-02 03:04 "},
+		{"posix-iso", nil, " 2020-01-02  "},
+		{"bogus", nil, " Jan 02 2020 "},
+		{"long-iso", []string{"--time-style=+%Y"}, " 2020 "},
+	}
+	for _, test := range tests {
+		t.Setenv("TIME_STYLE", test.env)
+		args := append(test.args, "-l", "--nocolor", "--tz=UTC", dir)
+		if output := runLs(t, args...); !strings.Contains(output, test.want) {
+			t.Errorf("TIME_STYLE=%s %v printed %q, want %q in it", test.env,
+				test.args, output, test.want)
+		}
+	}
+}
+
+func TestLocaleMonthNames(t *testing.T) {
+	tests := []struct {
+		lcAll, lcTime, lang string
+		want                string // the name of January, "" for C
+	}{
+		{"de_DE.UTF-8", "fr_FR.UTF-8", "es_ES.UTF-8", "Jan"},
+		{"", "fr_FR.UTF-8", "es_ES.UTF-8", "janv."},
+		{"", "", "es_ES.UTF-8", "ene"},
+		{"C", "de_DE.UTF-8", "", ""},
+		{"", "", "pt_BR.UTF-8", "jan"},
+		{"", "", "no_NO", "jan"},
+		{"", "", "ja_JP.eucJP", "1月"},
+		{"", "", "xx_YY.UTF-8", ""},
+		{"", "", "POSIX", ""},
+		{"", "", "", ""},
+	}
+	for _, test := range tests {
+		t.Setenv("LC_ALL", test.lcAll)
+		t.Setenv("LC_TIME", test.lcTime)
+		t.Setenv("LANG", test.lang)
+
+		got := ""
+		if names := getLocaleMonthNames(); names != nil {
+			got = names[0]
+		}
+		if got != test.want {
+			t.Errorf("LC_ALL=%q LC_TIME=%q LANG=%q: got %q, want %q",
+				test.lcAll, test.lcTime, test.lang, got, test.want)
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"path/filepath"
+	"sort"
+)
+
+// The best listings found so far for --top, as a heap with the worst of them on
+// top, so it is the one that makes room when a better listing comes along.
+type listingHeap struct {
+	listings []Listing
+	compare  func(a, b Listing) int // -1 if a is better than b
+}
+
+func (h *listingHeap) Len() int {
+	return len(h.listings)
+}
+
+func (h *listingHeap) Less(i, j int) bool {
+	return h.compare(h.listings[i], h.listings[j]) > 0
+}
+
+func (h *listingHeap) Swap(i, j int) {
+	h.listings[i], h.listings[j] = h.listings[j], h.listings[i]
+}
+
+func (h *listingHeap) Push(x interface{}) {
+	h.listings = append(h.listings, x.(Listing))
+}
+
+func (h *listingHeap) Pop() interface{} {
+	last := h.listings[len(h.listings)-1]
+	h.listings = h.listings[:len(h.listings)-1]
+	return last
+}
+
+// Offer a listing to the heap, which keeps at most n of them.
+func (h *listingHeap) offer(l Listing, n int) {
+	if h.Len() < n {
+		heap.Push(h, l)
+	} else if h.compare(l, h.listings[0]) < 0 {
+		h.listings[0] = l
+		heap.Fix(h, 0)
+	}
+}
+
+// Walk the given directories recursively and return the n regular files that
+// come first in the current sort order (the largest by default, the newest
+// with -t, the other end with -r), along with the regular files among files.
+// The names of the files found in the directories are paths relative to the
+// directory given.  The result is sorted in the same order.
+func getTopListings(ctx context.Context, output *outputWriter,
+	files []Listing, dirs []Listing, n int) ([]Listing, error) {
+	compare := getComparisonFunction()
+	if !options.sortTime && !options.sortSize && !options.sortCount {
+		compare = compareSize
+	}
+	if options.sortReverse {
+		forward := compare
+		compare = func(a, b Listing) int {
+			return -forward(a, b)
+		}
+	}
+	top := &listingHeap{make([]Listing, 0, n), compare}
+
+	for _, l := range files {
+		if l.permissions[0] == '-' {
+			top.offer(l, n)
+		}
+	}
+
+	err := walkListings(ctx, output, dirs,
+		func(dir Listing, listings []Listing) {
+			for _, l := range listings {
+				if l.permissions[0] == '-' {
+					l.name = filepath.Join(dir.name, l.name)
+					top.offer(l, n)
+				}
+			}
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	// sort by the key the files were picked by, not by the -t/-S default
+	sort.Slice(top.listings, func(i, j int) bool {
+		return compare(top.listings[i], top.listings[j]) < 0
+	})
+
+	return top.listings, nil
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a_big"), 5000)
+	writeTestFile(t, filepath.Join(dir, "b_small"), 10)
+	writeTestFile(t, filepath.Join(dir, "c_mid"), 100)
+	writeTestFile(t, filepath.Join(dir, "sub", "z_huge"), 300000)
+
+	// a_big is the newest, z_huge the oldest
+	now := time.Now()
+	for i, name := range []string{"a_big", "c_mid", "b_small",
+		"sub/z_huge"} {
+		mtime := now.Add(-time.Duration(i) * time.Hour)
+		err := os.Chtimes(filepath.Join(dir, name), mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--top=3"}, []string{"sub/z_huge", "a_big", "c_mid"}},
+		{[]string{"--top=2", "-r"}, []string{"b_small", "c_mid"}},
+		{[]string{"--top=2", "-t"}, []string{"a_big", "c_mid"}},
+		{[]string{"--top=2", "-t", "-r"}, []string{"sub/z_huge", "b_small"}},
+		{[]string{"--top=9", "-S"},
+			[]string{"sub/z_huge", "a_big", "c_mid", "b_small"}},
+	}
+	for _, test := range tests {
+		args := append(test.args, "--nocolor", dir)
+		want := make([]string, len(test.want))
+		for i, name := range test.want {
+			want[i] = filepath.Join(dir, name)
+		}
+
+		got := getLastFields(runLs(t, args...))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ls %v printed %v, want %v", test.args, got, want)
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"sort"
+)
+
+// The characters rectangles of the treemap are filled with.  Neighbouring
+// rectangles get different ones, so they can be told apart even in the same
+// color.
+var treemapShades = []string{"█", "▓", "▒", "░"}
+
+// One cell of the treemap: the character in it ("" for the second half of a
+// wide character) and its color.
+type treemapCell struct {
+	text  string
+	color string
+}
+
+// A rectangle of the treemap, in cells.
+type treemapRect struct {
+	x, y          int
+	width, height int
+}
+
+// Lay out the given listings, sorted from the largest, in a rectangle with
+// areas proportional to their sizes.  The listings are split in two groups of
+// about the same total size, the rectangle is cut across its longer side to
+// match, and both halves are laid out the same way.  Listings too small for a
+// single cell get an empty rectangle.
+func layoutTreemap(listings []Listing, area treemapRect, rects []treemapRect) {
+	if len(listings) == 0 {
+		return
+	} else if len(listings) == 1 {
+		rects[0] = area
+		return
+	}
+
+	total := int64(0)
+	for _, l := range listings {
+		total += l.sizeBytes
+	}
+
+	// the first split that puts half of the total size or more on the left
+	split := 1
+	left := listings[0].sizeBytes
+	for split < len(listings)-1 && 2*left < total {
+		left += listings[split].sizeBytes
+		split++
+	}
+
+	first := area
+	second := area
+	if total == 0 {
+		first.width, first.height = 0, 0
+	} else if area.width >= 2*area.height {
+		// cells are about twice as high as they are wide
+		first.width = int((int64(area.width)*left + total/2) / total)
+		second.x += first.width
+		second.width -= first.width
+	} else {
+		first.height = int((int64(area.height)*left + total/2) / total)
+		second.y += first.height
+		second.height -= first.height
+	}
+
+	layoutTreemap(listings[:split], first, rects[:split])
+	layoutTreemap(listings[split:], second, rects[split:])
+}
+
+// Report whether two rectangles share (part of) an edge.
+func isTreemapNeighbour(a treemapRect, b treemapRect) bool {
+	overlapX := a.x < b.x+b.width && b.x < a.x+a.width
+	overlapY := a.y < b.y+b.height && b.y < a.y+a.height
+
+	return (overlapY && (a.x+a.width == b.x || b.x+b.width == a.x)) ||
+		(overlapX && (a.y+a.height == b.y || b.y+b.height == a.y))
+}
+
+// Return the index in treemapShades of the shade for rectangle i: the first one
+// that none of the neighbours before it has.
+func getTreemapShade(rects []treemapRect, shades []int, i int) int {
+	used := make([]bool, len(treemapShades))
+	for j := 0; j < i; j++ {
+		if shades[j] >= 0 && isTreemapNeighbour(rects[i], rects[j]) {
+			used[shades[j]] = true
+		}
+	}
+
+	for shade := range used {
+		if !used[shade] {
+			return shade
+		}
+	}
+	return i % len(treemapShades)
+}
+
+// Write text into a row of cells from the given column, cutting it off at the
+// end of the row.
+func drawTreemapText(row []treemapCell, column int, text string,
+	color string) {
+	for _, r := range text {
+		width := displayWidth(string(r))
+		if width == 0 && column > 0 {
+			row[column-1].text += string(r)
+			continue
+		} else if column+width > len(row) {
+			return
+		}
+
+		row[column] = treemapCell{string(r), color}
+		if width == 2 {
+			row[column+1] = treemapCell{"", color}
+		}
+		column += width
+	}
+}
+
+// Write the treemap of the given listings, with a title line above it, in a
+// rectangle of the given size.
+func writeTreemap(output *outputWriter, title string, listings []Listing,
+	width int, height int) {
+	sorted := make([]Listing, 0, len(listings))
+	total := int64(0)
+	for _, l := range listings {
+		if l.name == "." || l.name == ".." || l.timedOut {
+			continue
+		}
+		sorted = append(sorted, l)
+		total += l.sizeBytes
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].sizeBytes > sorted[j].sizeBytes
+	})
+
+	if title != "" {
+		writeColored(output, quoteName(title), colorMap["directory"])
+		output.WriteString(" ")
+	}
+	output.WriteString(formatHumanSize(total))
+	if total == 0 {
+		return
+	}
+
+	grid := make([][]treemapCell, height)
+	for y := range grid {
+		grid[y] = make([]treemapCell, width)
+		for x := range grid[y] {
+			grid[y][x] = treemapCell{" ", ""}
+		}
+	}
+
+	rects := make([]treemapRect, len(sorted))
+	layoutTreemap(sorted, treemapRect{0, 0, width, height}, rects)
+	shades := make([]int, len(sorted))
+	for i, l := range sorted {
+		rect := rects[i]
+		shades[i] = -1
+		if rect.width <= 0 || rect.height <= 0 {
+			continue
+		}
+		shades[i] = getTreemapShade(rects, shades, i)
+
+		color := ""
+		if options.color {
+			color = getListingColor(l)
+		}
+		shade := treemapShades[shades[i]]
+		for y := rect.y; y < rect.y+rect.height; y++ {
+			for x := rect.x; x < rect.x+rect.width; x++ {
+				grid[y][x] = treemapCell{shade, color}
+			}
+		}
+
+		// the name and size on the first line, or on two if there is room
+		name := quoteName(l.name)
+		size := formatHumanSize(l.sizeBytes)
+		row := grid[rect.y][rect.x : rect.x+rect.width]
+		if displayWidth(name+" "+size) > rect.width && rect.height > 1 {
+			drawTreemapText(row, 0, name, color)
+			drawTreemapText(grid[rect.y+1][rect.x:rect.x+rect.width], 0, size,
+				color)
+		} else {
+			drawTreemapText(row, 0, name+" "+size, color)
+		}
+	}
+
+	// write every row, with one color code for each run of cells in a color
+	for _, row := range grid {
+		output.WriteString("\n")
+		for x := 0; x < len(row); {
+			run := ""
+			color := row[x].color
+			for ; x < len(row) && row[x].color == color; x++ {
+				run += row[x].text
+			}
+			writeColored(output, run, color)
+		}
+	}
+}
+
+// Print a --treemap of the given files, if any, and one of the contents of
+// each of the given directories (and of their subdirectories with -R), in the
+// terminal's dimensions.  One line is left for the title and one for the
+// prompt after the output.
+func writeTreemaps(ctx context.Context, output *outputWriter,
+	files []Listing, dirs []Listing, width int, height int) error {
+	height -= 2
+	if height < 1 {
+		height = 1
+	}
+
+	if len(files) > 0 {
+		writeTreemap(output, "", files, width, height)
+		output.deferString("\n\n")
+	}
+
+	err := walkListings(ctx, output, dirs,
+		func(dir Listing, listings []Listing) {
+			writeTreemap(output, dir.name, listings, width, height)
+			output.deferString("\n\n")
+		})
+	if err != nil {
+		return err
+	}
+	output.trimPending(2)
+
+	return nil
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+)
+
+// Lay out listings of the given sizes, which must be sorted from the largest,
+// in an area of the given size.
+func layoutTestTreemap(sizes []int64, width int, height int) []treemapRect {
+	listings := make([]Listing, len(sizes))
+	for i, size := range sizes {
+		listings[i].sizeBytes = size
+	}
+	rects := make([]treemapRect, len(sizes))
+	layoutTreemap(listings, treemapRect{0, 0, width, height}, rects)
+
+	return rects
+}
+
+// Report whether a rectangle covers no cells.
+func isEmptyRect(r treemapRect) bool {
+	return r.width <= 0 || r.height <= 0
+}
+
+var treemapTestSizes = [][]int64{
+	{1},
+	{5, 5},
+	{400, 300, 200, 100},
+	{1000, 500, 250, 125, 60, 30, 15, 8, 4, 2, 1},
+	{90, 80, 70, 60, 50, 40, 30, 20, 10},
+}
+
+func TestTreemapTiles(t *testing.T) {
+	for _, sizes := range treemapTestSizes {
+		width, height := 60, 20
+		rects := layoutTestTreemap(sizes, width, height)
+
+		// every cell is covered by exactly one rectangle
+		covered := make([]int, width*height)
+		for _, r := range rects {
+			if isEmptyRect(r) {
+				continue
+			}
+			if r.x < 0 || r.y < 0 || r.x+r.width > width ||
+				r.y+r.height > height {
+				t.Fatalf("%v: %v is outside the area", sizes, r)
+			}
+			for y := r.y; y < r.y+r.height; y++ {
+				for x := r.x; x < r.x+r.width; x++ {
+					covered[y*width+x]++
+				}
+			}
+		}
+		for i, n := range covered {
+			if n != 1 {
+				t.Errorf("%v: cell %d,%d is covered %d times", sizes,
+					i%width, i/width, n)
+				break
+			}
+		}
+	}
+}
+
+func TestTreemapProportions(t *testing.T) {
+	sizes := []int64{400, 300, 200, 100}
+	width, height := 80, 40
+	rects := layoutTestTreemap(sizes, width, height)
+
+	// off by at most a row or column of the area from rounding
+	for i, r := range rects {
+		want := int64(width*height) * sizes[i] / 1000
+		got := int64(r.width * r.height)
+		if got < want-int64(width) || got > want+int64(width) {
+			t.Errorf("size %d got %d cells, want about %d", sizes[i], got,
+				want)
+		}
+	}
+}
+
+func TestTreemapZeroSizes(t *testing.T) {
+	rects := layoutTestTreemap([]int64{100, 50, 0, 0}, 40, 10)
+	if isEmptyRect(rects[0]) || isEmptyRect(rects[1]) {
+		t.Errorf("%v: the files with a size got no cells", rects)
+	}
+	if !isEmptyRect(rects[2]) || !isEmptyRect(rects[3]) {
+		t.Errorf("%v: the empty files got cells", rects)
+	}
+}
+
+func TestTreemapShades(t *testing.T) {
+	for _, sizes := range treemapTestSizes {
+		rects := layoutTestTreemap(sizes, 60, 20)
+		shades := make([]int, len(rects))
+		for i := range rects {
+			shades[i] = -1
+			if !isEmptyRect(rects[i]) {
+				shades[i] = getTreemapShade(rects, shades, i)
+			}
+		}
+
+		for i := range rects {
+			for j := 0; j < i; j++ {
+				if shades[i] >= 0 && shades[j] >= 0 &&
+					isTreemapNeighbour(rects[i], rects[j]) &&
+					shades[i] == shades[j] {
+					t.Errorf("%v: neighbours %v and %v have the same shade",
+						sizes, rects[i], rects[j])
+				}
+			}
+		}
+	}
+}
+
+func TestTreemapNeighbours(t *testing.T) {
+	a := treemapRect{0, 0, 10, 5}
+	tests := []struct {
+		b    treemapRect
+		want bool
+	}{
+		{treemapRect{10, 0, 5, 5}, true},  // right
+		{treemapRect{0, 5, 3, 2}, true},   // below, in part
+		{treemapRect{10, 5, 5, 5}, false}, // only a corner
+		{treemapRect{11, 0, 5, 5}, false}, // a column apart
+	}
+	for _, test := range tests {
+		if got := isTreemapNeighbour(a, test.b); got != test.want {
+			t.Errorf("%v and %v: got %v, want %v", a, test.b, got, test.want)
+		}
+		if got := isTreemapNeighbour(test.b, a); got != test.want {
+			t.Errorf("%v and %v: got %v, want %v", test.b, a, got, test.want)
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+)
+
+// A directory waiting to be listed, with how deep below the command line
+// argument it is and the device of that argument (for --one-file-system).
+// Once the walker starts reading it, the result arrives on result.
+type queuedDir struct {
+	listing Listing
+	depth   int
+	rootDev uint64
+	result  chan dirResult
+}
+
+// The contents of a directory read by the walker, as listFilesInDir returns
+// them.
+type dirResult struct {
+	listings []Listing
+	err      error
+}
+
+// The tree walker hands out directories in the order a serial walk would list
+// them (every directory followed by its subdirectories), but reads the ones
+// next in line ahead of time, up to options.jobs of them at once.  Only a
+// bounded number of directories is read ahead, so a huge tree doesn't end up
+// in memory while the output catches up.
+type treeWalker struct {
+	ctx context.Context
+	// the directories still to list, a slice for every level of the tree
+	// being walked, the deepest (listed first) last
+	levels    [][]queuedDir
+	slots     chan struct{} // one for every directory being read
+	readAhead int           // how many queued directories may be read early
+}
+
+// Create a tree walker for the given directories.
+func newTreeWalker(ctx context.Context, dirs []queuedDir) *treeWalker {
+	jobs := options.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	w := &treeWalker{
+		ctx:       ctx,
+		levels:    make([][]queuedDir, 0),
+		slots:     make(chan struct{}, jobs),
+		readAhead: 4 * jobs,
+	}
+	w.push(dirs)
+
+	return w
+}
+
+// Start reading the directories next in line that aren't being read yet.
+func (w *treeWalker) startReads() {
+	queued := 0
+	for i := len(w.levels) - 1; i >= 0 && queued < w.readAhead; i-- {
+		level := w.levels[i]
+		for j := 0; j < len(level) && queued < w.readAhead; j++ {
+			queued++
+			if level[j].result != nil {
+				continue
+			}
+
+			result := make(chan dirResult, 1)
+			level[j].result = result
+			go func(dir Listing) {
+				select {
+				case w.slots <- struct{}{}:
+				case <-w.ctx.Done():
+					result <- dirResult{nil, w.ctx.Err()}
+					return
+				}
+				listings, err := listFilesInDir(w.ctx, dir)
+				<-w.slots
+				result <- dirResult{listings, err}
+			}(level[j].listing)
+		}
+	}
+}
+
+// Return the next directory to list, or false when the walk is done.
+func (w *treeWalker) next() (queuedDir, bool) {
+	if len(w.levels) == 0 {
+		return queuedDir{}, false
+	}
+
+	last := len(w.levels) - 1
+	dir := w.levels[last][0]
+	w.levels[last] = w.levels[last][1:]
+	if len(w.levels[last]) == 0 {
+		w.levels = w.levels[:last]
+	}
+	w.startReads()
+
+	return dir, true
+}
+
+// Wait for the contents of a directory returned by next.
+func (w *treeWalker) read(dir queuedDir) ([]Listing, error) {
+	result := <-dir.result
+	return result.listings, result.err
+}
+
+// Queue the subdirectories of the directory just listed, so they are listed
+// next, before the rest of the queue.
+func (w *treeWalker) push(subdirs []queuedDir) {
+	if len(subdirs) > 0 {
+		w.levels = append(w.levels, subdirs)
+	}
+	w.startReads()
+}
+
+// Walk the given directories (recursively with -R, honoring --max-depth,
+// --prune and --one-file-system) in the order -R lists them, and call visit
+// with the contents of each, or with the error that kept it from being read.
+// Directories that lead back to one above them are reported on stderr and
+// skipped.  The walk ends at the first error visit returns.
+func walkTree(ctx context.Context, output *outputWriter, dirs []Listing,
+	visit func(dir queuedDir, listings []Listing, err error) error) error {
+	// stop the directories read ahead once nobody waits for them any more
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make([]queuedDir, 0, len(dirs))
+	for _, d := range dirs {
+		queue = append(queue, queuedDir{d, 0, d.dev, nil})
+	}
+	walker := newTreeWalker(ctx, queue)
+
+	// the directories on the way to the current one, to notice cycles (e.g.
+	// through symlinks followed with -L) like GNU's active_dir_set: the same
+	// directory reached twice without a cycle is listed twice
+	active := make(map[[2]uint64]bool)
+	path := make([]queuedDir, 0)
+
+	for {
+		dir, ok := walker.next()
+		if !ok {
+			return nil
+		}
+		d := dir.listing
+
+		// leave the directories whose subtrees are done
+		for len(path) > 0 && path[len(path)-1].depth >= dir.depth {
+			done := path[len(path)-1].listing
+			if !done.timedOut {
+				delete(active, [2]uint64{done.dev, done.ino})
+			}
+			path = path[:len(path)-1]
+		}
+
+		if !d.timedOut && active[[2]uint64{d.dev, d.ino}] {
+			warn(output, "%s: not listing already-listed directory",
+				quoteName(d.name))
+			continue
+		}
+		if !d.timedOut {
+			active[[2]uint64{d.dev, d.ino}] = true
+		}
+		path = append(path, dir)
+
+		listings, err := walker.read(dir)
+		if err != nil && ctx.Err() != nil {
+			return err
+		}
+		if err := visit(dir, listings, err); err != nil {
+			return err
+		}
+
+		walker.push(getSubdirsToList(dir, listings))
+	}
+}
+
+// Walk the given directories like walkTree, and call visit with the contents of
+// each.  Directories that can't be read are reported on stderr and skipped.
+func walkListings(ctx context.Context, output *outputWriter, dirs []Listing,
+	visit func(dir Listing, listings []Listing)) error {
+	return walkTree(ctx, output, dirs,
+		func(dir queuedDir, listings []Listing, err error) error {
+			if err != nil {
+				warn(output, "cannot open directory %s: %v",
+					quoteName(dir.listing.name), err)
+				return nil
+			}
+
+			visit(dir.listing, listings)
+			return nil
+		})
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWalkCycles(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "sub", "file"), 0)
+	// two ways into sub, and a way from sub back up to dir
+	if err := os.Symlink("sub", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "sub", "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the directory headers of -R
+	headers := make([]string, 0)
+	output := runLs(t, "-RL", "--nocolor", "-1", dir)
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasSuffix(line, ":") {
+			headers = append(headers, strings.TrimPrefix(line, dir))
+		}
+	}
+
+	want := []string{":", "/link:", "/sub:"}
+	if strings.Join(headers, " ") != strings.Join(want, " ") {
+		t.Errorf("listed %v, want %v", headers, want)
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDisplayWidth(t *testing.T) {
+	tests := []struct {
+		text  string
+		width int
+	}{
+		{"", 0},
+		{"file.txt", 8},
+		{"e\u0301te\u0301", 3},            // combining acute accents
+		{"日本語.txt", 10},                   // wide CJK
+		{"한글", 4},                         // Hangul syllables
+		{"\u1100\u1161", 2},               // a leading and a medial jamo
+		{"Ａｂ", 4},                         // fullwidth Latin
+		{"ｱｲ", 2},                         // halfwidth katakana
+		{"\U0001f469\u200d\U0001f4bb", 2}, // emoji joined with a ZWJ
+		{"a\u200bb", 2},                   // zero width space
+		{"\u00ad", 1},                     // soft hyphen
+		{"a\tb\nc", 3},                    // control characters
+		{"\x1b[0m", 3},                    // only the escape is a control
+		{"\x7f", 0},
+		{"a\xffb", 3}, // an invalid byte
+	}
+
+	for _, test := range tests {
+		if width := displayWidth(test.text); width != test.width {
+			t.Errorf("displayWidth(%q) = %d, want %d", test.text, width,
+				test.width)
+		}
+	}
+}
+
+// vim: tabstop=4 softtabstop=4 shiftwidth=4 noexpandtab tw=80